@@ -0,0 +1,460 @@
+/*
+eventclient - client for accessing Cacophony events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+// RetryPolicy is how a Client waits for event-reporter when it isn't
+// running yet, such as while the device is booting. MaxWait is ignored
+// when the context has a deadline.
+type RetryPolicy struct {
+	Interval time.Duration // Time between attempts.
+	MaxWait  time.Duration // Give up waiting after this long. 0 waits until the context is done.
+}
+
+// DefaultRetryPolicy is used by NewClient and the package level functions.
+var DefaultRetryPolicy = RetryPolicy{
+	Interval: 500 * time.Millisecond,
+	MaxWait:  10 * time.Second,
+}
+
+// EventSink is what programs making events add them to. Client adds them
+// to event-reporter over D-Bus; eventclienttest.Recorder records them so
+// tests can check the events made.
+type EventSink interface {
+	AddEvent(ctx context.Context, event Event) error
+	AddEvents(ctx context.Context, events []Event) error
+	UploadEvents(ctx context.Context) error
+}
+
+var _ EventSink = (*Client)(nil)
+
+// ErrServiceUnavailable is returned when event-reporter isn't running and
+// didn't start before the retry policy or context gave up.
+var ErrServiceUnavailable = errors.New("dbus service not available within the timeout period")
+
+// Client makes calls to event-reporter over one D-Bus connection. The
+// context given to each method can cancel the call and its deadline
+// limits how long to wait for event-reporter.
+type Client struct {
+	conn  *dbus.Conn
+	obj   dbus.BusObject
+	Retry RetryPolicy
+
+	// SpoolDir is where AddEvent and AddEvents write events when
+	// event-reporter isn't running, for it to add when it starts. Events
+	// aren't spooled if it is empty.
+	SpoolDir string
+}
+
+// NewClient returns a client using the shared system bus connection.
+func NewClient() (*Client, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConn(conn), nil
+}
+
+// NewClientWithConn returns a client using the given connection.
+func NewClientWithConn(conn *dbus.Conn) *Client {
+	return &Client{
+		conn:     conn,
+		obj:      conn.Object("org.cacophony.Events", "/org/cacophony/Events"),
+		Retry:    DefaultRetryPolicy,
+		SpoolDir: DefaultSpoolDir,
+	}
+}
+
+// AddEvent adds an event. If event-reporter isn't running the event is
+// spooled, see SpoolDir.
+func (c *Client) AddEvent(ctx context.Context, event Event) error {
+	return c.spoolIfUnavailable(c.addEvent(ctx, event), event)
+}
+
+func (c *Client) addEvent(ctx context.Context, event Event) error {
+	detailsBytes, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+	if event.IdempotencyKey != "" {
+		_, err = c.call(ctx,
+			"org.cacophony.Events.AddIdempotent",
+			string(detailsBytes),
+			event.Type,
+			event.Timestamp.UnixNano(),
+			event.IdempotencyKey)
+		return err
+	}
+	_, err = c.call(ctx,
+		"org.cacophony.Events.Add",
+		string(detailsBytes),
+		event.Type,
+		event.Timestamp.UnixNano())
+	return err
+}
+
+// AddEventWithID adds an event and returns the key it was given, which
+// can be used with GetEvent and DeleteEvent. The key is 0 if the event
+// was rate limited. If the event has an idempotency key and is a repeat,
+// the key of the original event is returned.
+func (c *Client) AddEventWithID(ctx context.Context, event Event) (uint64, error) {
+	detailsBytes, err := json.Marshal(event.Details)
+	if err != nil {
+		return 0, err
+	}
+	var data []interface{}
+	if event.IdempotencyKey != "" {
+		data, err = c.call(ctx,
+			"org.cacophony.Events.AddIdempotent",
+			string(detailsBytes),
+			event.Type,
+			event.Timestamp.UnixNano(),
+			event.IdempotencyKey)
+	} else {
+		data, err = c.call(ctx,
+			"org.cacophony.Events.AddWithID",
+			string(detailsBytes),
+			event.Type,
+			event.Timestamp.UnixNano())
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 1 {
+		return 0, errors.New("error adding event")
+	}
+	id, ok := data[0].(uint64)
+	if !ok {
+		return 0, errors.New("error reading event key")
+	}
+	return id, nil
+}
+
+// AddEvents adds several events with one D-Bus call. This is much quicker
+// than calling AddEvent for each when adding a lot of events at once. If
+// event-reporter isn't running the events are spooled, see SpoolDir.
+func (c *Client) AddEvents(ctx context.Context, events []Event) error {
+	return c.spoolIfUnavailable(c.addEvents(ctx, events), events...)
+}
+
+func (c *Client) addEvents(ctx context.Context, events []Event) error {
+	type batchEvent struct {
+		Details  string
+		Type     string
+		UnixNsec int64
+	}
+	batch := make([]batchEvent, 0, len(events))
+	for _, event := range events {
+		detailsBytes, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, batchEvent{
+			Details:  string(detailsBytes),
+			Type:     event.Type,
+			UnixNsec: event.Timestamp.UnixNano(),
+		})
+	}
+	_, err := c.call(ctx, "org.cacophony.Events.AddBatch", batch)
+	return err
+}
+
+func (c *Client) GetEventKeys(ctx context.Context) ([]uint64, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.GetKeys")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting event keys")
+	}
+	eventKeys, ok := data[0].([]uint64)
+	if !ok {
+		return nil, errors.New("error reading event keys")
+	}
+	return eventKeys, nil
+}
+
+func (c *Client) GetEvent(ctx context.Context, key uint64) (*Event, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.Get", key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting event data")
+	}
+	eventString, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading event data")
+	}
+	var event eventstore.Event
+	if err := json.Unmarshal([]byte(eventString), &event); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Timestamp: event.Timestamp,
+		Type:      event.Description.Type,
+		Details:   event.Description.Details,
+	}, nil
+}
+
+func (c *Client) DeleteEvent(ctx context.Context, key uint64) error {
+	_, err := c.call(ctx, "org.cacophony.Events.Delete", key)
+	return err
+}
+
+// GetQuarantinedKeys returns the keys of events that were quarantined
+// after repeatedly failing to upload.
+func (c *Client) GetQuarantinedKeys(ctx context.Context) ([]uint64, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.GetQuarantinedKeys")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting quarantined keys")
+	}
+	keys, ok := data[0].([]uint64)
+	if !ok {
+		return nil, errors.New("error reading quarantined keys")
+	}
+	return keys, nil
+}
+
+// GetQuarantinedEvent returns a quarantined event and its failed upload attempts.
+func (c *Client) GetQuarantinedEvent(ctx context.Context, key uint64) (*eventstore.QuarantinedEvent, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.GetQuarantined", key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting quarantined event")
+	}
+	eventString, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading quarantined event")
+	}
+	q := &eventstore.QuarantinedEvent{}
+	if err := json.Unmarshal([]byte(eventString), q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// ReplayQuarantinedEvent moves a quarantined event back to be uploaded.
+// The event is given a new key, which is returned.
+func (c *Client) ReplayQuarantinedEvent(ctx context.Context, key uint64) (uint64, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.ReplayQuarantined", key)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 1 {
+		return 0, errors.New("error replaying quarantined event")
+	}
+	newKey, ok := data[0].(uint64)
+	if !ok {
+		return 0, errors.New("error reading event key")
+	}
+	return newKey, nil
+}
+
+// DeleteQuarantinedEvent permanently deletes a quarantined event.
+func (c *Client) DeleteQuarantinedEvent(ctx context.Context, key uint64) error {
+	_, err := c.call(ctx, "org.cacophony.Events.DeleteQuarantined", key)
+	return err
+}
+
+// RegisterDestination adds a destination that events must be delivered
+// to before they are deleted.
+func (c *Client) RegisterDestination(ctx context.Context, name string) error {
+	_, err := c.call(ctx, "org.cacophony.Events.RegisterDestination", name)
+	return err
+}
+
+// UnregisterDestination removes a destination.
+func (c *Client) UnregisterDestination(ctx context.Context, name string) error {
+	_, err := c.call(ctx, "org.cacophony.Events.UnregisterDestination", name)
+	return err
+}
+
+// GetPendingKeys returns the keys of events not yet delivered to the destination.
+func (c *Client) GetPendingKeys(ctx context.Context, destination string) ([]uint64, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.PendingFor", destination)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting pending keys")
+	}
+	keys, ok := data[0].([]uint64)
+	if !ok {
+		return nil, errors.New("error reading pending keys")
+	}
+	return keys, nil
+}
+
+// MarkDelivered records that the events were delivered to the destination.
+func (c *Client) MarkDelivered(ctx context.Context, destination string, keys []uint64) error {
+	_, err := c.call(ctx, "org.cacophony.Events.MarkDelivered", destination, keys)
+	return err
+}
+
+// GetEventsSince returns up to limit events with a key after cursor and the
+// cursor to use to get the next page. Start with a cursor of 0, or the one
+// from GetCursor to resume.
+func (c *Client) GetEventsSince(ctx context.Context, cursor uint64, limit uint32) ([]KeyedEvent, uint64, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.GetSince", cursor, limit)
+	if err != nil {
+		return nil, cursor, err
+	}
+	if len(data) != 2 {
+		return nil, cursor, errors.New("error getting events")
+	}
+	eventsString, ok := data[0].(string)
+	if !ok {
+		return nil, cursor, errors.New("error reading events")
+	}
+	next, ok := data[1].(uint64)
+	if !ok {
+		return nil, cursor, errors.New("error reading next cursor")
+	}
+	events, err := decodeKeyedEvents(eventsString)
+	if err != nil {
+		return nil, cursor, err
+	}
+	return events, next, nil
+}
+
+// QueryEvents returns the events matching the filter, oldest first.
+func (c *Client) QueryEvents(ctx context.Context, filter eventstore.Filter) ([]KeyedEvent, error) {
+	filterBytes, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.call(ctx, "org.cacophony.Events.Query", string(filterBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error querying events")
+	}
+	eventsString, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading events")
+	}
+	return decodeKeyedEvents(eventsString)
+}
+
+// Ack saves the cursor the collector has got events up to.
+func (c *Client) Ack(ctx context.Context, collector string, cursor uint64) error {
+	_, err := c.call(ctx, "org.cacophony.Events.Ack", collector, cursor)
+	return err
+}
+
+// GetCursor returns the last cursor acknowledged by the collector.
+func (c *Client) GetCursor(ctx context.Context, collector string) (uint64, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.GetCursor", collector)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 1 {
+		return 0, errors.New("error getting cursor")
+	}
+	cursor, ok := data[0].(uint64)
+	if !ok {
+		return 0, errors.New("error reading cursor")
+	}
+	return cursor, nil
+}
+
+// GetStatus returns the upload status and statistics of the event store.
+func (c *Client) GetStatus(ctx context.Context) (*Status, error) {
+	data, err := c.call(ctx, "org.cacophony.Events.Status")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting status")
+	}
+	statusString, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading status")
+	}
+	status := &Status{}
+	if err := json.Unmarshal([]byte(statusString), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// UploadEvents requests for the events to be uploaded now.
+func (c *Client) UploadEvents(ctx context.Context) error {
+	_, err := c.call(ctx, "org.cacophony.Events.UploadEvents")
+	return err
+}
+
+// call makes a D-Bus call to event-reporter, retrying while it isn't
+// running until the retry policy or the context gives up.
+func (c *Client) call(ctx context.Context, method string, params ...interface{}) ([]interface{}, error) {
+	startTime := time.Now()
+	maxWait := c.Retry.MaxWait
+	if _, ok := ctx.Deadline(); ok {
+		maxWait = 0
+	}
+	for {
+		var call *dbus.Call
+		select {
+		case call = <-c.obj.Go(method, 0, make(chan *dbus.Call, 1), params...).Done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.Err == nil {
+			return call.Body, nil
+		}
+
+		dbusErr, ok := call.Err.(dbus.Error)
+		if !ok {
+			return nil, call.Err
+		}
+		switch dbusErr.Name {
+		case "org.freedesktop.DBus.Error.ServiceUnknown":
+			if maxWait > 0 && time.Since(startTime) > maxWait {
+				return nil, ErrServiceUnavailable
+			}
+			select {
+			case <-time.After(c.Retry.Interval):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w: %w", ErrServiceUnavailable, ctx.Err())
+			}
+		case "org.cacophony.Events.Errors.ValidationFailed":
+			return nil, &ValidationError{Message: fmt.Sprint(dbusErr.Body...)}
+		default:
+			return nil, call.Err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+eventclient - client for accessing Cacophony events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeObject answers calls with the queued errors, then succeeds.
+type fakeObject struct {
+	errs  []error
+	calls int
+}
+
+func (o *fakeObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	return <-o.Go(method, flags, make(chan *dbus.Call, 1), args...).Done
+}
+
+func (o *fakeObject) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	call := &dbus.Call{Method: method, Args: args, Done: ch, Body: []interface{}{"ok"}}
+	if o.calls < len(o.errs) {
+		call.Err = o.errs[o.calls]
+		call.Body = nil
+	}
+	o.calls++
+	ch <- call
+	return call
+}
+
+func (o *fakeObject) GetProperty(p string) (dbus.Variant, error) {
+	return dbus.Variant{}, errors.New("no properties")
+}
+
+func (o *fakeObject) Destination() string   { return "org.cacophony.Events" }
+func (o *fakeObject) Path() dbus.ObjectPath { return "/org/cacophony/Events" }
+
+var errServiceUnknown = dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}
+
+func newFakeClient(retry RetryPolicy, errs ...error) (*Client, *fakeObject) {
+	obj := &fakeObject{errs: errs}
+	return &Client{obj: obj, Retry: retry}, obj
+}
+
+func TestCallRetriesUntilAvailable(t *testing.T) {
+	c, obj := newFakeClient(RetryPolicy{Interval: time.Millisecond}, errServiceUnknown, errServiceUnknown)
+	body, err := c.call(context.Background(), "org.cacophony.Events.GetKeys")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"ok"}, body)
+	assert.Equal(t, 3, obj.calls)
+}
+
+func TestCallGivesUpAfterMaxWait(t *testing.T) {
+	errs := make([]error, 1000)
+	for i := range errs {
+		errs[i] = errServiceUnknown
+	}
+	c, _ := newFakeClient(RetryPolicy{Interval: time.Millisecond, MaxWait: 10 * time.Millisecond}, errs...)
+	_, err := c.call(context.Background(), "org.cacophony.Events.GetKeys")
+	assert.Equal(t, ErrServiceUnavailable, err)
+}
+
+func TestCallDeadlineOverridesMaxWait(t *testing.T) {
+	// Still unavailable after MaxWait, but the deadline hasn't passed.
+	errs := make([]error, 20)
+	for i := range errs {
+		errs[i] = errServiceUnknown
+	}
+	c, obj := newFakeClient(RetryPolicy{Interval: time.Millisecond, MaxWait: time.Millisecond}, errs...)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := c.call(ctx, "org.cacophony.Events.GetKeys")
+	require.NoError(t, err)
+	assert.Equal(t, 21, obj.calls)
+}
+
+func TestCallCancelled(t *testing.T) {
+	c, _ := newFakeClient(RetryPolicy{Interval: time.Hour}, errServiceUnknown)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.call(ctx, "org.cacophony.Events.GetKeys")
+	assert.ErrorIs(t, err, ErrServiceUnavailable)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	c, _ = newFakeClient(RetryPolicy{Interval: time.Hour}, errServiceUnknown)
+	_, err = c.call(ctx, "org.cacophony.Events.GetKeys")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCallValidationFailed(t *testing.T) {
+	c, _ := newFakeClient(DefaultRetryPolicy, dbus.Error{
+		Name: "org.cacophony.Events.Errors.ValidationFailed",
+		Body: []interface{}{"missing field"},
+	})
+	_, err := c.call(context.Background(), "org.cacophony.Events.Add")
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "missing field", validationErr.Message)
+}
+
+func TestCallOtherError(t *testing.T) {
+	failed := dbus.Error{Name: "org.cacophony.Events.Errors.AddFailed"}
+	c, obj := newFakeClient(DefaultRetryPolicy, failed)
+	_, err := c.call(context.Background(), "org.cacophony.Events.Add")
+	assert.Equal(t, failed, err)
+	assert.Equal(t, 1, obj.calls)
+}
@@ -19,12 +19,11 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package eventclient
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"sync"
 	"time"
 
-	"github.com/godbus/dbus"
-
 	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
 )
 
@@ -36,99 +35,261 @@ const (
 	SeverityError   = "error"   // Something went wrong.
 )
 
+// ValidationError is returned when adding an event with details that
+// don't match the schema for its type, and event-reporter is rejecting
+// invalid events.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
 type Event struct {
 	Timestamp time.Time
 	Type      string
 	Details   map[string]interface{}
+
+	// IdempotencyKey is optional. If set, adding an event with the same
+	// key again within a day is ignored, so adding can be safely retried.
+	IdempotencyKey string
+}
+
+// KeyedEvent is an event along with its key in the event store.
+type KeyedEvent struct {
+	Key uint64
+	Event
+}
+
+// Status is how event-reporter is getting on with uploading events. It
+// helps tell an empty queue from connectivity problems and API failures.
+type Status struct {
+	eventstore.Stats
+	LastAttempt         time.Time `json:"lastAttempt"`         // Start of the last upload attempt.
+	LastSuccess         time.Time `json:"lastSuccess"`         // End of the last upload that didn't fail.
+	LastError           string    `json:"lastError"`           // Error of the last failed upload.
+	ConsecutiveFailures int       `json:"consecutiveFailures"` // Failed uploads since the last success.
+}
+
+var (
+	defaultClient    *Client
+	defaultClientMux sync.Mutex
+)
+
+// getDefaultClient returns the client used by the package level functions.
+// It is made on first use, and again if that failed.
+func getDefaultClient() (*Client, error) {
+	defaultClientMux.Lock()
+	defer defaultClientMux.Unlock()
+	if defaultClient == nil {
+		client, err := NewClient()
+		if err != nil {
+			return nil, err
+		}
+		defaultClient = client
+	}
+	return defaultClient, nil
 }
 
 func AddEvent(event Event) error {
-	detailsBytes, err := json.Marshal(event.Details)
+	c, err := getDefaultClient()
 	if err != nil {
 		return err
 	}
-	_, err = eventsDbusCall(
-		"org.cacophony.Events.Add",
-		string(detailsBytes),
-		event.Type,
-		event.Timestamp.UnixNano())
-	return err
+	return c.AddEvent(context.Background(), event)
 }
 
-func GetEventKeys() ([]uint64, error) {
-	data, err := eventsDbusCall("org.cacophony.Events.GetKeys")
+// AddEventWithID adds an event and returns the key it was given. See
+// Client.AddEventWithID.
+func AddEventWithID(event Event) (uint64, error) {
+	c, err := getDefaultClient()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	if len(data) != 1 {
-		return nil, errors.New("error getting event keys")
+	return c.AddEventWithID(context.Background(), event)
+}
+
+// AddEvents adds several events with one D-Bus call. This is much quicker
+// than calling AddEvent for each when adding a lot of events at once.
+func AddEvents(events []Event) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
 	}
-	eventKeys, ok := data[0].([]uint64)
-	if !ok {
-		return nil, errors.New("error reading event keys")
+	return c.AddEvents(context.Background(), events)
+}
+
+func GetEventKeys() ([]uint64, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
 	}
-	return eventKeys, nil
+	return c.GetEventKeys(context.Background())
 }
 
 func GetEvent(key uint64) (*Event, error) {
-	data, err := eventsDbusCall("org.cacophony.Events.Get", key)
+	c, err := getDefaultClient()
 	if err != nil {
 		return nil, err
 	}
-	if len(data) != 1 {
-		return nil, errors.New("error getting event data")
+	return c.GetEvent(context.Background(), key)
+}
+
+func DeleteEvent(key uint64) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
 	}
-	eventString, ok := data[0].(string)
-	if !ok {
-		return nil, errors.New("error reading event data")
+	return c.DeleteEvent(context.Background(), key)
+}
+
+// GetQuarantinedKeys returns the keys of events that were quarantined
+// after repeatedly failing to upload.
+func GetQuarantinedKeys() ([]uint64, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
 	}
-	var event eventstore.Event
-	if err := json.Unmarshal([]byte(eventString), &event); err != nil {
+	return c.GetQuarantinedKeys(context.Background())
+}
+
+// GetQuarantinedEvent returns a quarantined event and its failed upload attempts.
+func GetQuarantinedEvent(key uint64) (*eventstore.QuarantinedEvent, error) {
+	c, err := getDefaultClient()
+	if err != nil {
 		return nil, err
 	}
-	return &Event{
-		Timestamp: event.Timestamp,
-		Type:      event.Description.Type,
-		Details:   event.Description.Details,
-	}, nil
+	return c.GetQuarantinedEvent(context.Background(), key)
 }
 
-func DeleteEvent(key uint64) error {
-	_, err := eventsDbusCall("org.cacophony.Events.Delete", key)
-	return err
+// ReplayQuarantinedEvent moves a quarantined event back to be uploaded.
+// The event is given a new key, which is returned.
+func ReplayQuarantinedEvent(key uint64) (uint64, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return 0, err
+	}
+	return c.ReplayQuarantinedEvent(context.Background(), key)
 }
 
-// UploadEvents wil reuqest for the events to be uploaded now
-func UploadEvents() error {
-	_, err := eventsDbusCall("org.cacophony.Events.UploadEvents")
-	return err
+// DeleteQuarantinedEvent permanently deletes a quarantined event.
+func DeleteQuarantinedEvent(key uint64) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
+	}
+	return c.DeleteQuarantinedEvent(context.Background(), key)
 }
 
-func eventsDbusCall(method string, params ...interface{}) ([]interface{}, error) {
+// RegisterDestination adds a destination that events must be delivered
+// to before they are deleted.
+func RegisterDestination(name string) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
+	}
+	return c.RegisterDestination(context.Background(), name)
+}
 
-	// Retry mechanism with a maximum wait time of 10 seconds
-	maxWaitTime := 10 * time.Second
-	startTime := time.Now()
+// UnregisterDestination removes a destination.
+func UnregisterDestination(name string) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
+	}
+	return c.UnregisterDestination(context.Background(), name)
+}
 
-	conn, err := dbus.SystemBus()
+// GetPendingKeys returns the keys of events not yet delivered to the destination.
+func GetPendingKeys(destination string) ([]uint64, error) {
+	c, err := getDefaultClient()
 	if err != nil {
 		return nil, err
 	}
-	obj := conn.Object("org.cacophony.Events", "/org/cacophony/Events")
-	for {
-		call := obj.Call(method, 0, params...)
+	return c.GetPendingKeys(context.Background(), destination)
+}
 
-		if call.Err == nil {
-			return call.Body, call.Err
-		}
+// MarkDelivered records that the events were delivered to the destination.
+func MarkDelivered(destination string, keys []uint64) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
+	}
+	return c.MarkDelivered(context.Background(), destination, keys)
+}
 
-		if dbusErr, ok := call.Err.(dbus.Error); ok && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
-			if time.Since(startTime) > maxWaitTime {
-				return nil, errors.New("dbus service not available within the timeout period")
-			}
-			time.Sleep(500 * time.Millisecond)
-		} else {
-			return nil, call.Err
-		}
+// GetEventsSince returns up to limit events with a key after cursor and the
+// cursor to use to get the next page. Start with a cursor of 0, or the one
+// from GetCursor to resume.
+func GetEventsSince(cursor uint64, limit uint32) ([]KeyedEvent, uint64, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, cursor, err
+	}
+	return c.GetEventsSince(context.Background(), cursor, limit)
+}
+
+// QueryEvents returns the events matching the filter, oldest first.
+func QueryEvents(filter eventstore.Filter) ([]KeyedEvent, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.QueryEvents(context.Background(), filter)
+}
+
+func decodeKeyedEvents(eventsString string) ([]KeyedEvent, error) {
+	var storeEvents []eventstore.KeyedEvent
+	if err := json.Unmarshal([]byte(eventsString), &storeEvents); err != nil {
+		return nil, err
+	}
+	events := make([]KeyedEvent, 0, len(storeEvents))
+	for _, e := range storeEvents {
+		events = append(events, KeyedEvent{
+			Key: e.Key,
+			Event: Event{
+				Timestamp: e.Event.Timestamp,
+				Type:      e.Event.Description.Type,
+				Details:   e.Event.Description.Details,
+			},
+		})
+	}
+	return events, nil
+}
+
+// Ack saves the cursor the collector has got events up to.
+func Ack(collector string, cursor uint64) error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
+	}
+	return c.Ack(context.Background(), collector, cursor)
+}
+
+// GetCursor returns the last cursor acknowledged by the collector.
+func GetCursor(collector string) (uint64, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return 0, err
+	}
+	return c.GetCursor(context.Background(), collector)
+}
+
+// GetStatus returns the upload status and statistics of the event store.
+func GetStatus() (*Status, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.GetStatus(context.Background())
+}
+
+// UploadEvents wil reuqest for the events to be uploaded now
+func UploadEvents() error {
+	c, err := getDefaultClient()
+	if err != nil {
+		return err
 	}
+	return c.UploadEvents(context.Background())
 }
@@ -0,0 +1,172 @@
+/*
+eventclienttest - fake eventclient for testing programs that make events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package eventclienttest has an in-memory eventclient.EventSink for
+// testing programs that make events.
+package eventclienttest
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// Recorder is an eventclient.EventSink that records the events added to
+// it. If Err is set it is returned instead of recording the events.
+type Recorder struct {
+	Err error
+
+	mux     sync.Mutex
+	events  []eventclient.Event
+	uploads int
+}
+
+var _ eventclient.EventSink = (*Recorder)(nil)
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) AddEvent(ctx context.Context, event eventclient.Event) error {
+	return r.AddEvents(ctx, []eventclient.Event{event})
+}
+
+func (r *Recorder) AddEvents(ctx context.Context, events []eventclient.Event) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func (r *Recorder) UploadEvents(ctx context.Context) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.uploads++
+	return nil
+}
+
+// Events returns the events added, oldest first.
+func (r *Recorder) Events() []eventclient.Event {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]eventclient.Event{}, r.events...)
+}
+
+// EventsOfType returns the events of the type added, oldest first.
+func (r *Recorder) EventsOfType(eventType string) []eventclient.Event {
+	var events []eventclient.Event
+	for _, event := range r.Events() {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Uploads returns how many times UploadEvents was called.
+func (r *Recorder) Uploads() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.uploads
+}
+
+// Reset forgets the events and uploads recorded.
+func (r *Recorder) Reset() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.events = nil
+	r.uploads = 0
+}
+
+// AssertCount checks that count events of the type were added.
+func (r *Recorder) AssertCount(t testing.TB, eventType string, count int) bool {
+	t.Helper()
+	if n := len(r.EventsOfType(eventType)); n != count {
+		t.Errorf("expected %d '%s' event(s), got %d", count, eventType, n)
+		return false
+	}
+	return true
+}
+
+// AssertDetailsContain checks that an event of the type was added with
+// the details given, and maybe others. Details are compared as JSON, as
+// event-reporter stores them, so 1 and 1.0 are equal.
+func (r *Recorder) AssertDetailsContain(t testing.TB, eventType string, details map[string]interface{}) bool {
+	t.Helper()
+	want, err := normalise(details)
+	if err != nil {
+		t.Errorf("failed to encode details: %v", err)
+		return false
+	}
+	events := r.EventsOfType(eventType)
+	for _, event := range events {
+		got, err := normalise(event.Details)
+		if err != nil {
+			t.Errorf("failed to encode details of '%s' event: %v", eventType, err)
+			return false
+		}
+		if containsDetails(got, want) {
+			return true
+		}
+	}
+	if len(events) == 0 {
+		t.Errorf("expected a '%s' event with details %v, got none of that type", eventType, details)
+	} else {
+		t.Errorf("expected a '%s' event with details %v, got %v", eventType, details, detailsOf(events))
+	}
+	return false
+}
+
+func containsDetails(got, want map[string]interface{}) bool {
+	for key, value := range want {
+		gotValue, ok := got[key]
+		if !ok || !reflect.DeepEqual(gotValue, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalise returns the details as they would be after being sent to
+// event-reporter as JSON.
+func normalise(details map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	return out, json.Unmarshal(data, &out)
+}
+
+func detailsOf(events []eventclient.Event) []map[string]interface{} {
+	details := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		details = append(details, event.Details)
+	}
+	return details
+}
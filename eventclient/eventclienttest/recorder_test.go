@@ -0,0 +1,84 @@
+/*
+eventclienttest - fake eventclient for testing programs that make events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclienttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// fakeT records the errors from failed assertions.
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	r := NewRecorder()
+	assert.NoError(t, r.AddEvent(ctx, eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      "systemError",
+		Details:   map[string]interface{}{"unitName": "a", "logs": []string{"x"}, "count": 1},
+	}))
+	assert.NoError(t, r.AddEvents(ctx, []eventclient.Event{
+		{Type: "rpiBattery", Details: map[string]interface{}{"voltage": 3.7}},
+		{Type: "rpiBattery", Details: map[string]interface{}{"voltage": 3.6}},
+	}))
+	assert.NoError(t, r.UploadEvents(ctx))
+
+	assert.Len(t, r.Events(), 3)
+	assert.Len(t, r.EventsOfType("rpiBattery"), 2)
+	assert.Equal(t, 1, r.Uploads())
+	assert.True(t, r.AssertCount(t, "systemError", 1))
+	assert.True(t, r.AssertCount(t, "other", 0))
+	assert.True(t, r.AssertDetailsContain(t, "rpiBattery", map[string]interface{}{"voltage": 3.6}))
+	// Compared as JSON, so a float is equal to the int detail.
+	assert.True(t, r.AssertDetailsContain(t, "systemError", map[string]interface{}{
+		"count": 1.0,
+		"logs":  []interface{}{"x"},
+	}))
+
+	ft := &fakeT{}
+	assert.False(t, r.AssertCount(ft, "systemError", 2))
+	assert.False(t, r.AssertDetailsContain(ft, "rpiBattery", map[string]interface{}{"voltage": 3.5}))
+	assert.False(t, r.AssertDetailsContain(ft, "other", map[string]interface{}{}))
+	assert.Len(t, ft.errors, 3)
+
+	r.Err = errors.New("event-reporter down")
+	assert.Error(t, r.AddEvent(ctx, eventclient.Event{Type: "lost"}))
+	r.AssertCount(t, "lost", 0)
+
+	r.Reset()
+	assert.Empty(t, r.Events())
+	assert.Zero(t, r.Uploads())
+}
@@ -0,0 +1,105 @@
+/*
+eventclient - client for accessing Cacophony events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DefaultSpoolDir is where events are spooled when event-reporter isn't
+// running. event-reporter adds them when it starts and then periodically.
+const DefaultSpoolDir = "/var/spool/cacophony-events"
+
+// SpoolFileSuffix is the extension of spool files. Each process appends
+// its events to its own file as JSON lines.
+//
+// Writers hold an exclusive flock while appending. event-reporter renames
+// a file before reading it, then takes the lock to wait for any writer
+// that opened it before the rename. Writers check the file they locked is
+// still the one at the path, so nothing is written after it is read.
+const SpoolFileSuffix = ".jsonl"
+
+// spoolIfUnavailable spools the events if err is because event-reporter
+// isn't running. Any other error is returned.
+func (c *Client) spoolIfUnavailable(err error, events ...Event) error {
+	if !errors.Is(err, ErrServiceUnavailable) || c.SpoolDir == "" {
+		return err
+	}
+	if spoolErr := spool(c.SpoolDir, events); spoolErr != nil {
+		return fmt.Errorf("%w, and failed to spool events: %w", err, spoolErr)
+	}
+	return nil
+}
+
+func spool(dir string, events []Event) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d%s", os.Getpid(), SpoolFileSuffix))
+	for {
+		written, err := appendLocked(path, buf.Bytes())
+		if err != nil || written {
+			return err
+		}
+	}
+}
+
+// appendLocked appends data to the file while holding its lock. It
+// returns false if the file was taken by event-reporter before the lock
+// was got, so should be tried again.
+func appendLocked(path string, data []byte) (bool, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return false, err
+	}
+	locked, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !os.SameFile(locked, current) {
+		return false, nil
+	}
+	if _, err := f.Write(data); err != nil {
+		return false, err
+	}
+	return true, f.Close()
+}
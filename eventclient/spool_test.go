@@ -0,0 +1,177 @@
+/*
+eventclient - client for accessing Cacophony events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readSpool returns the events in a spool file, failing if any line isn't
+// a valid event.
+func readSpool(t *testing.T, path string) []Event {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event), "invalid line %q", scanner.Text())
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func spoolPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", os.Getpid(), SpoolFileSuffix))
+}
+
+// newUnavailableClient returns a client that can't reach event-reporter.
+func newUnavailableClient(spoolDir string) *Client {
+	errs := make([]error, 1000)
+	for i := range errs {
+		errs[i] = errServiceUnknown
+	}
+	c, _ := newFakeClient(RetryPolicy{Interval: time.Millisecond, MaxWait: 5 * time.Millisecond}, errs...)
+	c.SpoolDir = spoolDir
+	return c
+}
+
+func TestSpoolWhenUnavailable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	c := newUnavailableClient(dir)
+	now := time.Now().Truncate(time.Second)
+	event := Event{Timestamp: now, Type: "test", Details: map[string]interface{}{"a": "b"}, IdempotencyKey: "test-1"}
+	require.NoError(t, c.AddEvent(context.Background(), event))
+	batch := []Event{
+		{Timestamp: now, Type: "batch", Details: map[string]interface{}{"i": 1.0}},
+		{Timestamp: now, Type: "batch", Details: map[string]interface{}{"i": 2.0}},
+	}
+	require.NoError(t, c.AddEvents(context.Background(), batch))
+
+	events := readSpool(t, spoolPath(dir))
+	require.Len(t, events, 3)
+	assert.Equal(t, event.Type, events[0].Type)
+	assert.Equal(t, event.Details, events[0].Details)
+	assert.Equal(t, event.IdempotencyKey, events[0].IdempotencyKey)
+	assert.True(t, now.Equal(events[0].Timestamp))
+	assert.Equal(t, batch[0].Details, events[1].Details)
+	assert.Equal(t, batch[1].Details, events[2].Details)
+}
+
+func TestNoSpoolDir(t *testing.T) {
+	c := newUnavailableClient("")
+	err := c.AddEvent(context.Background(), Event{Timestamp: time.Now(), Type: "test"})
+	assert.ErrorIs(t, err, ErrServiceUnavailable)
+	err = c.AddEvents(context.Background(), []Event{{Timestamp: time.Now(), Type: "test"}})
+	assert.ErrorIs(t, err, ErrServiceUnavailable)
+}
+
+func TestNoSpoolOnOtherErrors(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := newFakeClient(DefaultRetryPolicy, dbus.Error{
+		Name: "org.cacophony.Events.Errors.ValidationFailed",
+		Body: []interface{}{"missing field"},
+	})
+	c.SpoolDir = dir
+	var validationErr *ValidationError
+	assert.ErrorAs(t, c.AddEvent(context.Background(), Event{Timestamp: time.Now(), Type: "test"}), &validationErr)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestConcurrentSpooling(t *testing.T) {
+	dir := t.TempDir()
+	// Big enough that a write isn't done in one go.
+	padding := strings.Repeat("x", 64*1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				event := Event{
+					Timestamp: time.Now(),
+					Type:      "concurrent",
+					Details:   map[string]interface{}{"writer": i, "padding": padding},
+				}
+				assert.NoError(t, spool(dir, []Event{event, event}))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	events := readSpool(t, spoolPath(dir))
+	assert.Len(t, events, 200)
+	counts := map[float64]int{}
+	for _, event := range events {
+		counts[event.Details["writer"].(float64)]++
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 20, counts[float64(i)])
+	}
+}
+
+func TestSpoolRacingIngest(t *testing.T) {
+	dir := t.TempDir()
+	path := spoolPath(dir)
+	require.NoError(t, spool(dir, []Event{{Timestamp: time.Now(), Type: "before"}}))
+
+	// Lock the file as event-reporter does while it is being read.
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX))
+
+	done := make(chan error)
+	go func() {
+		done <- spool(dir, []Event{{Timestamp: time.Now(), Type: "after"}})
+	}()
+	// Give the writer time to open the file and wait for the lock.
+	time.Sleep(50 * time.Millisecond)
+	ingesting := path + ".ingesting"
+	require.NoError(t, os.Rename(path, ingesting))
+	require.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_UN))
+	require.NoError(t, <-done)
+
+	// The event is written to a new file rather than the one taken.
+	taken := readSpool(t, ingesting)
+	require.Len(t, taken, 1)
+	assert.Equal(t, "before", taken[0].Type)
+	written := readSpool(t, path)
+	require.Len(t, written, 1)
+	assert.Equal(t, "after", written[0].Type)
+}
@@ -0,0 +1,155 @@
+/*
+eventclient - client for accessing Cacophony events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclient
+
+import (
+	"context"
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+const signalMatchRule = "type='signal',interface='org.cacophony.Events',path='/org/cacophony/Events'"
+
+// Signal is a signal from event-reporter. It is one of EventAdded,
+// UploadStarted, UploadCompleted or EventsDropped.
+type Signal interface {
+	isSignal()
+}
+
+// EventAdded is sent when an event is added to the event store.
+type EventAdded struct {
+	ID       uint64
+	Type     string
+	Severity string
+}
+
+// UploadStarted is sent when event-reporter starts uploading events.
+type UploadStarted struct{}
+
+// UploadCompleted is sent when an upload has finished. Err is set if any
+// event failed to upload, whether or not it will be retried.
+type UploadCompleted struct {
+	Sent   int
+	Failed int
+	Err    string
+}
+
+// EventsDropped is sent when events are dropped because they were rate
+// limited ("rateLimit") or the event store was full ("limits").
+type EventsDropped struct {
+	Reason string
+	Count  int
+}
+
+func (EventAdded) isSignal()      {}
+func (UploadStarted) isSignal()   {}
+func (UploadCompleted) isSignal() {}
+func (EventsDropped) isSignal()   {}
+
+// Subscribe returns a channel that gets the signals from event-reporter
+// until the context is done, when the channel is closed.
+func Subscribe(ctx context.Context) (<-chan Signal, error) {
+	c, err := getDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.Subscribe(ctx)
+}
+
+// Subscribe returns a channel that gets the signals from event-reporter
+// until the context is done, when the channel is closed.
+func (c *Client) Subscribe(ctx context.Context) (<-chan Signal, error) {
+	conn := c.conn
+	call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, signalMatchRule)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+	in := make(chan *dbus.Signal, 10)
+	conn.Signal(in)
+
+	out := make(chan Signal, 10)
+	go func() {
+		defer close(out)
+		receive(ctx, in, out)
+
+		// Signals are delivered while holding a lock that RemoveSignal
+		// needs, so keep receiving until the channel has been removed.
+		go func() {
+			conn.RemoveSignal(in)
+			conn.BusObject().Call("org.freedesktop.DBus.RemoveMatch", 0, signalMatchRule)
+			close(in)
+		}()
+		for range in {
+		}
+	}()
+	return out, nil
+}
+
+func receive(ctx context.Context, in <-chan *dbus.Signal, out chan<- Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-in:
+			signal, ok := parseSignal(s)
+			if !ok {
+				continue
+			}
+			select {
+			case out <- signal:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// parseSignal converts a D-Bus signal from event-reporter. Other signals
+// on the connection are ignored.
+func parseSignal(s *dbus.Signal) (Signal, bool) {
+	if s.Path != "/org/cacophony/Events" || !strings.HasPrefix(s.Name, "org.cacophony.Events.") {
+		return nil, false
+	}
+	var signal Signal
+	var err error
+	switch strings.TrimPrefix(s.Name, "org.cacophony.Events.") {
+	case "EventAdded":
+		var e EventAdded
+		err = dbus.Store(s.Body, &e.ID, &e.Type, &e.Severity)
+		signal = e
+	case "UploadStarted":
+		signal = UploadStarted{}
+	case "UploadCompleted":
+		var sent, failed uint32
+		var e UploadCompleted
+		err = dbus.Store(s.Body, &sent, &failed, &e.Err)
+		e.Sent, e.Failed = int(sent), int(failed)
+		signal = e
+	case "EventsDropped":
+		var count uint32
+		var e EventsDropped
+		err = dbus.Store(s.Body, &e.Reason, &count)
+		e.Count = int(count)
+		signal = e
+	default:
+		return nil, false
+	}
+	return signal, err == nil
+}
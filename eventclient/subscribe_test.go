@@ -0,0 +1,96 @@
+/*
+eventclient - client for accessing Cacophony events
+Copyright (C) 2020, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package eventclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignal(t *testing.T) {
+	const path = dbus.ObjectPath("/org/cacophony/Events")
+	tests := []struct {
+		name   string
+		signal *dbus.Signal
+		want   Signal
+	}{
+		{
+			name:   "EventAdded t,s,s",
+			signal: &dbus.Signal{Path: path, Name: "org.cacophony.Events.EventAdded", Body: []interface{}{uint64(7), "systemError", "error"}},
+			want:   EventAdded{ID: 7, Type: "systemError", Severity: "error"},
+		},
+		{
+			name:   "UploadStarted",
+			signal: &dbus.Signal{Path: path, Name: "org.cacophony.Events.UploadStarted"},
+			want:   UploadStarted{},
+		},
+		{
+			name:   "UploadCompleted u,u,s",
+			signal: &dbus.Signal{Path: path, Name: "org.cacophony.Events.UploadCompleted", Body: []interface{}{uint32(3), uint32(1), "timeout"}},
+			want:   UploadCompleted{Sent: 3, Failed: 1, Err: "timeout"},
+		},
+		{
+			name:   "EventsDropped s,u",
+			signal: &dbus.Signal{Path: path, Name: "org.cacophony.Events.EventsDropped", Body: []interface{}{"rateLimit", uint32(5)}},
+			want:   EventsDropped{Reason: "rateLimit", Count: 5},
+		},
+		{
+			name:   "wrong body signature",
+			signal: &dbus.Signal{Path: path, Name: "org.cacophony.Events.EventsDropped", Body: []interface{}{uint32(5), "rateLimit"}},
+		},
+		{
+			name:   "unknown member",
+			signal: &dbus.Signal{Path: path, Name: "org.cacophony.Events.Other"},
+		},
+		{
+			name:   "other interface",
+			signal: &dbus.Signal{Path: path, Name: "org.freedesktop.DBus.NameOwnerChanged", Body: []interface{}{"a", "b", "c"}},
+		},
+		{
+			name:   "other path",
+			signal: &dbus.Signal{Path: "/org/cacophony/Other", Name: "org.cacophony.Events.UploadStarted"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signal, ok := parseSignal(test.signal)
+			assert.Equal(t, test.want != nil, ok)
+			if ok {
+				assert.Equal(t, test.want, signal)
+			}
+		})
+	}
+}
+
+func TestReceiveSkipsForeignSignals(t *testing.T) {
+	in := make(chan *dbus.Signal, 2)
+	out := make(chan Signal, 2)
+	in <- &dbus.Signal{Path: "/org/freedesktop/DBus", Name: "org.freedesktop.DBus.NameAcquired", Body: []interface{}{":1.5"}}
+	in <- &dbus.Signal{Path: "/org/cacophony/Events", Name: "org.cacophony.Events.UploadStarted"}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		assert.Equal(t, UploadStarted{}, <-out)
+		cancel()
+	}()
+	receive(ctx, in, out)
+	assert.Empty(t, out)
+}
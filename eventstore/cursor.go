@@ -0,0 +1,126 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/boltdb/bolt"
+)
+
+// Event keys come from the bucket sequence so they only ever increase.
+// That lets a key be used as a cursor by collectors, like sidekick, that
+// pull events incrementally and need to resume after being interrupted.
+
+// KeyedEvent is an event along with its key.
+type KeyedEvent struct {
+	Key   uint64 `json:"key"`
+	Event Event  `json:"event"`
+}
+
+// GetSince returns up to limit events with a key after cursor, oldest
+// first, and the cursor for getting the next page. The cursor returned
+// is unchanged if there are no more events.
+func (s *EventStore) GetSince(cursor uint64, limit int) ([]KeyedEvent, uint64, error) {
+	events := []KeyedEvent{}
+	if cursor == math.MaxUint64 {
+		return events, cursor, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idDataBucketName)
+		if bucket == nil {
+			return noBucketErr(idDataBucketName)
+		}
+		// Keys are little endian so bolt doesn't keep them in numeric
+		// order, the key index does.
+		keyIndex, err := keyIndexBucket(tx)
+		if err != nil {
+			return err
+		}
+		c := keyIndex.Cursor()
+		for k, _ := c.Seek(keyIndexKey(cursor + 1)); k != nil; k, _ = c.Next() {
+			if limit > 0 && len(events) >= limit {
+				break
+			}
+			e := KeyedEvent{Key: keyFromIndex(k)}
+			if err := json.Unmarshal(bucket.Get(uint64ToBytes(e.Key)), &e.Event); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, cursor, err
+	}
+	if len(events) > 0 {
+		cursor = events[len(events)-1].Key
+	}
+	return events, cursor, nil
+}
+
+// Ack saves the cursor of the collector so it can resume from there. If
+// the collector is also a registered destination, the events up to the
+// cursor are marked as delivered to it.
+func (s *EventStore) Ack(collector string, cursor uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cursors := tx.Bucket(cursorsBucketName)
+		if cursors == nil {
+			return noBucketErr(cursorsBucketName)
+		}
+		if val := cursors.Get([]byte(collector)); val != nil && bytesToUint64(val) > cursor {
+			return nil // Cursors only move forward.
+		}
+		if err := cursors.Put([]byte(collector), uint64ToBytes(cursor)); err != nil {
+			return err
+		}
+
+		if _, err := destinationBucket(tx, collector); err != nil {
+			return nil
+		}
+		keyIndex, err := keyIndexBucket(tx)
+		if err != nil {
+			return err
+		}
+		var keys []uint64
+		c := keyIndex.Cursor()
+		for k, _ := c.First(); k != nil && keyFromIndex(k) <= cursor; k, _ = c.Next() {
+			keys = append(keys, keyFromIndex(k))
+		}
+		return markDelivered(tx, collector, keys)
+	})
+}
+
+// GetCursor returns the last cursor acknowledged by the collector, or 0
+// if it hasn't acknowledged any.
+func (s *EventStore) GetCursor(collector string) (uint64, error) {
+	var cursor uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursors := tx.Bucket(cursorsBucketName)
+		if cursors == nil {
+			return noBucketErr(cursorsBucketName)
+		}
+		if val := cursors.Get([]byte(collector)); val != nil {
+			cursor = bytesToUint64(val)
+		}
+		return nil
+	})
+	return cursor, err
+}
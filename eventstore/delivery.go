@@ -0,0 +1,266 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Events can be delivered to several destinations, such as the Cacophony
+// API and sidekick. Each registered destination has a bucket inside the
+// delivered bucket holding the keys of the events it has been given or
+// has quarantined. An event is deleted once every registered destination
+// has it, or quarantined if any destination quarantined it.
+
+// RegisterDestination adds a destination that events must be delivered
+// to before they are deleted.
+func (s *EventStore) RegisterDestination(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		delivered := tx.Bucket(deliveredBucketName)
+		if delivered == nil {
+			return noBucketErr(deliveredBucketName)
+		}
+		_, err := delivered.CreateBucketIfNotExists([]byte(name))
+		return err
+	})
+}
+
+// UnregisterDestination removes a destination and its failed attempts.
+// Events that every remaining destination has now delivered or quarantined
+// are removed.
+func (s *EventStore) UnregisterDestination(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		delivered := tx.Bucket(deliveredBucketName)
+		if delivered == nil {
+			return noBucketErr(deliveredBucketName)
+		}
+		if delivered.Bucket([]byte(name)) == nil {
+			return nil
+		}
+		if err := delivered.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+		attempts := tx.Bucket(attemptsBucketName)
+		if attempts == nil {
+			return noBucketErr(attemptsBucketName)
+		}
+		if attempts.Bucket([]byte(name)) != nil {
+			if err := attempts.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		bucket := tx.Bucket(idDataBucketName)
+		if bucket == nil {
+			return noBucketErr(idDataBucketName)
+		}
+		var keys [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		return removeIfSettled(tx, keys)
+	})
+}
+
+// Destinations returns the names of the registered destinations.
+func (s *EventStore) Destinations() ([]string, error) {
+	names := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		delivered := tx.Bucket(deliveredBucketName)
+		if delivered == nil {
+			return noBucketErr(deliveredBucketName)
+		}
+		return delivered.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// PendingFor returns the keys of events that haven't been delivered to
+// or quarantined by the destination.
+func (s *EventStore) PendingFor(destination string) ([]uint64, error) {
+	keys := []uint64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		dest, err := destinationBucket(tx, destination)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(idDataBucketName)
+		if bucket == nil {
+			return noBucketErr(idDataBucketName)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if dest.Get(k) == nil {
+				keys = append(keys, bytesToUint64(k))
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// MarkDelivered records that the events have been delivered to the
+// destination. Events that every registered destination has are deleted.
+func (s *EventStore) MarkDelivered(destination string, keys []uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return markDelivered(tx, destination, keys)
+	})
+}
+
+func markDelivered(tx *bolt.Tx, destination string, keys []uint64) error {
+	dest, err := destinationBucket(tx, destination)
+	if err != nil {
+		return err
+	}
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return noBucketErr(idDataBucketName)
+	}
+	var delivered [][]byte
+	for _, key := range keys {
+		k := uint64ToBytes(key)
+		if bucket.Get(k) == nil {
+			continue // Already deleted.
+		}
+		if err := dest.Put(k, []byte{}); err != nil {
+			return err
+		}
+		delivered = append(delivered, k)
+	}
+	return removeIfSettled(tx, delivered)
+}
+
+func destinationBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	delivered := tx.Bucket(deliveredBucketName)
+	if delivered == nil {
+		return nil, noBucketErr(deliveredBucketName)
+	}
+	dest := delivered.Bucket([]byte(name))
+	if dest == nil {
+		return nil, fmt.Errorf("destination '%s' is not registered", name)
+	}
+	return dest, nil
+}
+
+// removeIfSettled removes the events that every registered destination
+// has delivered or quarantined. They are moved into the quarantine bucket
+// if any destination quarantined them, and deleted otherwise. Nothing is
+// removed if there are no destinations registered.
+func removeIfSettled(tx *bolt.Tx, keys [][]byte) error {
+	delivered := tx.Bucket(deliveredBucketName)
+	if delivered == nil {
+		return noBucketErr(deliveredBucketName)
+	}
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return noBucketErr(idDataBucketName)
+	}
+	var dests []*bolt.Bucket
+	delivered.ForEach(func(k, v []byte) error {
+		dests = append(dests, delivered.Bucket(k))
+		return nil
+	})
+	if len(dests) == 0 {
+		return nil
+	}
+	for _, key := range keys {
+		if bucket.Get(key) == nil {
+			continue // Already removed.
+		}
+		settled, quarantined := true, false
+		for _, dest := range dests {
+			mark := dest.Get(key)
+			if mark == nil {
+				settled = false
+				break
+			}
+			if bytes.Equal(mark, quarantinedMark) {
+				quarantined = true
+			}
+		}
+		if !settled {
+			continue
+		}
+		var err error
+		if quarantined {
+			err = moveEvents(tx, idDataBucketName, quarantineBucketName, []uint64{bytesToUint64(key)})
+		} else {
+			err = deleteEvent(tx, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearDelivered removes the record of which destinations have an event.
+func clearDelivered(tx *bolt.Tx, key []byte) error {
+	delivered := tx.Bucket(deliveredBucketName)
+	if delivered == nil {
+		return noBucketErr(deliveredBucketName)
+	}
+	var dests [][]byte
+	delivered.ForEach(func(k, v []byte) error {
+		dests = append(dests, k)
+		return nil
+	})
+	for _, name := range dests {
+		if err := delivered.Bucket(name).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveDelivered moves the record of which destinations have an event to
+// its new key. The marks of destinations that quarantined it are dropped
+// so it is pending for them again.
+func moveDelivered(tx *bolt.Tx, from, to []byte) error {
+	delivered := tx.Bucket(deliveredBucketName)
+	if delivered == nil {
+		return noBucketErr(deliveredBucketName)
+	}
+	var dests [][]byte
+	delivered.ForEach(func(k, v []byte) error {
+		dests = append(dests, k)
+		return nil
+	})
+	for _, name := range dests {
+		dest := delivered.Bucket(name)
+		mark := dest.Get(from)
+		if mark == nil {
+			continue
+		}
+		if !bytes.Equal(mark, quarantinedMark) {
+			if err := dest.Put(to, append([]byte{}, mark...)); err != nil {
+				return err
+			}
+		}
+		if err := dest.Delete(from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
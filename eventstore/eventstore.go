@@ -23,7 +23,6 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"math"
 	"sync"
 	"time"
 
@@ -38,19 +37,45 @@ const (
 
 var oldBucketName = []byte("events")
 var idDataBucketName = []byte("id-data-events") // Bucket with the key being a uint64 and the value being a json
+var metaBucketName = []byte("meta")             // Bucket for store bookkeeping such as the schema version
+var attemptsBucketName = []byte("attempts")     // A bucket for each destination holding its failed upload attempts
+var quarantineBucketName = []byte("quarantine-events")
+var stateBucketName = []byte("state")                  // State of the event reporter that should survive restarts
+var deliveredBucketName = []byte("delivered")          // A bucket for each destination holding the keys delivered to it
+var cursorsBucketName = []byte("cursors")              // Last key acknowledged by each collector
+var typeIndexBucketName = []byte("index-type-time")    // Events by type and timestamp, see index.go
+var timeIndexBucketName = []byte("index-time")         // Events by timestamp
+var keyIndexBucketName = []byte("index-key")           // Event keys in numeric order
+var rateLimitsBucketName = []byte("rate-limits")       // Rate limiter token bucket of each event type
+var idempotencyBucketName = []byte("idempotency-keys") // Recent idempotency keys and the event they added
+var bucketNames = [][]byte{
+	oldBucketName,
+	idDataBucketName,
+	metaBucketName,
+	attemptsBucketName,
+	quarantineBucketName,
+	stateBucketName,
+	deliveredBucketName,
+	cursorsBucketName,
+	typeIndexBucketName,
+	timeIndexBucketName,
+	keyIndexBucketName,
+	rateLimitsBucketName,
+	idempotencyBucketName,
+}
 var log = logging.NewLogger("info")
 
 // EventStore perists details for events which are to be sent to the
 // Cacophony Events API.
 type EventStore struct {
-	db         *bolt.DB
-	mux        sync.Mutex
-	rateLimits map[string]rateLimit
-}
-
-type rateLimit struct {
-	time  time.Time
-	count int
+	db              *bolt.DB
+	mux             sync.Mutex
+	updateMux       sync.Mutex
+	rateLimits      map[string]rateLimit
+	rateLimitConfig RateLimits
+	limitsMux       sync.Mutex
+	limits          Limits
+	notifier        Notifier
 }
 
 // Open opens the event store. It should be closed later with the
@@ -63,19 +88,46 @@ func Open(fileName, logLevel string) (*EventStore, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(oldBucketName)
-		if err != nil {
-			return err
+		for _, name := range bucketNames {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
-		_, err = tx.CreateBucketIfNotExists(idDataBucketName)
-		return err
+		return nil
 	})
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("creating bucket: %v", err)
 	}
 
-	return &EventStore{db: db, rateLimits: make(map[string]rateLimit)}, nil
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating event store: %v", err)
+	}
+
+	// The indexes are updated along with the events so should never be
+	// out of step, but if they are Query would silently miss events.
+	if err := db.Update(ensureIndexes); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("rebuilding event indexes: %v", err)
+	}
+
+	var rateLimits map[string]rateLimit
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		rateLimits, err = loadRateLimits(tx, time.Now())
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("loading rate limits: %v", err)
+	}
+
+	return &EventStore{
+		db:              db,
+		rateLimits:      rateLimits,
+		rateLimitConfig: DefaultRateLimits().Merge(RateLimits{}),
+	}, nil
 }
 
 // Use Add for adding new events now. This is keept for testing migrations
@@ -116,6 +168,7 @@ type EventDescription struct {
 	Details map[string]interface{} `json:"details"`
 }
 
+// whitelist has the types that are exempt from rate limiting by default.
 var whitelist = map[string]struct{}{
 	"UnrecoverableDataCorruption":    {},
 	"CorruptFile":                    {},
@@ -129,101 +182,146 @@ var whitelist = map[string]struct{}{
 	"config":                         {},
 }
 
-// shouldBeRateLimited checks if that type of event is being made too often.
-// Each time an event is made, if an event of that same type was made in the last 3 minutes
-// a counter will be incremented. Otherwise the counter will be reset to 0.
-// If the counter is 5 or more the events will be rate limited.
-// When the counter reaches 5, an rate_limit event will be made
-// There is a whitelist of events that are not rate limited, these events are made when offloading
-// recordings so it is expected that there will be a lot of these events in a short amount of time.
-func (s *EventStore) shouldBeRateLimited(event *Event) bool {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
-	eventType := event.Description.Type
-	eventTime := event.Timestamp
-
-	// Checking if the event type is in the whitelist
-	if _, ok := whitelist[eventType]; ok {
-		return false
-	}
+var getNodegroupFunc = saltutil.GetNodegroupFromFile
 
-	rl, ok := s.rateLimits[eventType]
+func (s *EventStore) Add(event *Event) error {
+	return s.AddMany([]Event{*event})
+}
 
-	// Checking if the event type is in the rate limit map
-	if !ok {
-		// No rate limit for this event type, initializing rate limit then return false
-		s.rateLimits[eventType] = rateLimit{time: eventTime, count: 0}
-		return false
-	}
+// AddMany adds the events in a single transaction. Rate limiting is
+// applied to each event in turn, as if they were added one at a time.
+func (s *EventStore) AddMany(events []Event) error {
+	return s.update(func(tx *bolt.Tx, c *changes) error {
+		var toAdd []*Event
+		for i := range events {
+			limited, rateLimitEvents := s.shouldBeRateLimited(c, &events[i])
+			toAdd = append(toAdd, rateLimitEvents...)
+			if limited {
+				log.Warnf("Rate limited '%s' event", events[i].Description.Type)
+				c.drop(DroppedRateLimit, 1)
+				continue
+			}
+			toAdd = append(toAdd, &events[i])
+		}
+		_, err := s.putEvents(tx, toAdd, c)
+		return err
+	})
+}
 
-	// Checking if the event is within 3 minutes of the last event
-	// Note that math.Abs is used here as when the RP2040 offloads events
-	// it will work if offloading newest to oldest or oldest to newest.
-	counter := rl.count
-	if math.Abs(eventTime.Sub(rl.time).Minutes()) < 3 {
-		// Event is within 3 minutes of the last event, incrementing count
-		counter++
-	} else {
-		// Event is not within 3 minutes of the last event, resetting count
-		counter = 0
-	}
+// AddWithID adds the event and returns the key it was given, or 0 if it
+// was rate limited.
+func (s *EventStore) AddWithID(event *Event) (uint64, error) {
+	return s.addEvent(event, "")
+}
 
-	// When counter reaches 5 make an event showing that it is getting rate limited,
-	// Only when counter == 5, don't want to rate limit the rate limit events..
-	if counter == 5 {
-		details := map[string]interface{}{"rate_limited_event": eventType, "severity": "error"}
-		environment, err := getNodegroupFunc()
-		if err != nil {
-			log.Errorf("failed to read nodegroup file: %v", err)
+// addEvent adds a single event and returns its key. If an idempotency key
+// is given it is remembered, unless an event has already been added with
+// it, in which case the key of that event is returned instead.
+func (s *EventStore) addEvent(event *Event, idempotencyKey string) (uint64, error) {
+	var id uint64
+	err := s.update(func(tx *bolt.Tx, c *changes) error {
+		if idempotencyKey != "" {
+			// Checked first so repeats don't count towards the rate limit.
+			var found bool
+			var err error
+			id, found, err = getIdempotencyKey(tx, idempotencyKey, time.Now())
+			if err != nil || found {
+				return err
+			}
+		}
+		limited, toAdd := s.shouldBeRateLimited(c, event)
+		if limited {
+			log.Warnf("Rate limited '%s' event", event.Description.Type)
+			c.drop(DroppedRateLimit, 1)
 		} else {
-			details["env"] = environment
+			toAdd = append(toAdd, event)
 		}
-		err = s.add(&Event{
-			Timestamp: time.Now(),
-			Description: EventDescription{
-				Type:    "rateLimit",
-				Details: details,
-			}})
-		if err != nil {
-			log.Errorf("failed to add rate limit event: %v", err)
+		keys, err := s.putEvents(tx, toAdd, c)
+		if err != nil || limited {
+			return err
+		}
+		id = keys[len(keys)-1]
+		if idempotencyKey == "" {
+			return nil
 		}
+		return putIdempotencyKey(tx, idempotencyKey, id, time.Now())
+	})
+	if err != nil {
+		return 0, err
 	}
-
-	// Updating rate limit
-	s.rateLimits[eventType] = rateLimit{time: eventTime, count: counter}
-
-	return counter >= 5
+	return id, nil
 }
 
-var getNodegroupFunc = saltutil.GetNodegroupFromFile
+// AddLegacy adds an event given in the format used by the deprecated
+// Queue method. The details are the JSON encoded description that was
+// sent to the API, one event is added for each timestamp.
+func (s *EventStore) AddLegacy(details []byte, timestamps ...time.Time) error {
+	return s.AddMany(legacyEvents(details, timestamps))
+}
 
-func (s *EventStore) Add(event *Event) error {
-	if s.shouldBeRateLimited(event) {
-		log.Warnf("Rate limited '%s' event", event.Description.Type)
-		return nil
+// update runs fn in a write transaction. Once it has been committed the
+// changes to the rate limits are applied and the notifier is told what
+// was changed. Updates are serialised so the rate limits are always
+// worked out from what has been committed.
+func (s *EventStore) update(fn func(tx *bolt.Tx, c *changes) error) error {
+	s.updateMux.Lock()
+	c := &changes{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx, c); err != nil {
+			return err
+		}
+		return saveRateLimits(tx, c)
+	})
+	if err == nil {
+		s.applyRateLimits(c)
 	}
+	s.updateMux.Unlock()
+	if err != nil {
+		return err
+	}
+	s.notify(c)
+	return nil
+}
 
-	return s.add(event)
+// putEvents stores the events and enforces the limits of the store. The
+// keys given to the events are returned and the changes made are
+// recorded in c.
+func (s *EventStore) putEvents(tx *bolt.Tx, events []*Event, c *changes) ([]uint64, error) {
+	keys := make([]uint64, 0, len(events))
+	for _, event := range events {
+		log.Printf("Adding new '%s' event\n", event.Description.Type)
+		key, err := putEvent(tx, event)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		c.added = append(c.added, KeyedEvent{Key: key, Event: *event})
+	}
+	return keys, s.enforceLimits(tx, c)
 }
 
-func (s *EventStore) add(event *Event) error {
-	log.Printf("Adding new '%s' event\n", event.Description.Type)
+// putEvent stores and indexes the event under the next sequence number of
+// the id-data bucket and returns the key it was given.
+func putEvent(tx *bolt.Tx, event *Event) (uint64, error) {
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return 0, noBucketErr(idDataBucketName)
+	}
 	data, err := json.Marshal(event)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(idDataBucketName)
-		if bucket == nil {
-			return noBucketErr(idDataBucketName)
-		}
-		nextSeq, err := bucket.NextSequence()
-		if err != nil {
-			return err
-		}
-		return bucket.Put(uint64ToBytes(nextSeq), data)
-	})
+	nextSeq, err := bucket.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	if err := bucket.Put(uint64ToBytes(nextSeq), data); err != nil {
+		return 0, err
+	}
+	if err := adjustStoredSize(tx, 1, int64(8+len(data))); err != nil {
+		return 0, err
+	}
+	return nextSeq, indexEvent(tx, nextSeq, event)
 }
 
 func uint64ToBytes(i uint64) []byte {
@@ -273,14 +371,34 @@ func noBucketErr(name []byte) error {
 
 func (s *EventStore) Delete(key uint64) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(idDataBucketName)
-		if bucket == nil {
-			return noBucketErr(idDataBucketName)
-		}
-		return bucket.Delete(uint64ToBytes(key))
+		return deleteEvent(tx, uint64ToBytes(key))
 	})
 }
 
+// deleteEvent removes an event and everything stored about it.
+func deleteEvent(tx *bolt.Tx, key []byte) error {
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return noBucketErr(idDataBucketName)
+	}
+	val := bucket.Get(key)
+	if err := unindexStored(tx, key, val); err != nil {
+		return err
+	}
+	if val != nil {
+		if err := adjustStoredSize(tx, -1, -int64(len(key)+len(val))); err != nil {
+			return err
+		}
+	}
+	if err := bucket.Delete(key); err != nil {
+		return err
+	}
+	if err := clearAttempts(tx, key); err != nil {
+		return err
+	}
+	return clearDelivered(tx, key)
+}
+
 func (s *EventStore) DeleteKeys(keys []uint64) error {
 	for _, key := range keys {
 		if err := s.Delete(key); err != nil {
@@ -300,26 +418,10 @@ func (s *EventStore) All() ([]EventTimes, error) {
 		cursor := bucket.Cursor()
 
 		for key, rec := cursor.First(); key != nil; key, rec = cursor.Next() {
-			var version byte
-			reader := bytes.NewReader(rec)
-			err := binary.Read(reader, binary.LittleEndian, &version)
+			timestamps, err := decodeTimestamps(rec)
 			if err != nil {
-				return fmt.Errorf("failed to read version: %v", err)
-			}
-			if version != 0 {
-				return fmt.Errorf("unsupported version: %v", version)
+				return err
 			}
-
-			var timestamps []time.Time
-			for {
-				var nanos int64
-				err := binary.Read(reader, binary.LittleEndian, &nanos)
-				if err != nil {
-					break
-				}
-				timestamps = append(timestamps, time.Unix(0, nanos))
-			}
-
 			out = append(out, newEventTimes(key, timestamps...))
 		}
 
@@ -331,6 +433,32 @@ func (s *EventStore) All() ([]EventTimes, error) {
 	return out, nil
 }
 
+// decodeTimestamps reads the timestamps from a record in the old events
+// bucket. The record is a version byte followed by little endian
+// nanosecond timestamps.
+func decodeTimestamps(rec []byte) ([]time.Time, error) {
+	var version byte
+	reader := bytes.NewReader(rec)
+	err := binary.Read(reader, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version: %v", err)
+	}
+	if version != 0 {
+		return nil, fmt.Errorf("unsupported version: %v", version)
+	}
+
+	var timestamps []time.Time
+	for {
+		var nanos int64
+		err := binary.Read(reader, binary.LittleEndian, &nanos)
+		if err != nil {
+			break
+		}
+		timestamps = append(timestamps, time.Unix(0, nanos))
+	}
+	return timestamps, nil
+}
+
 // Discard removes an event from from the store.
 func (s *EventStore) Discard(ev EventTimes) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
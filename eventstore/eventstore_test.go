@@ -20,11 +20,16 @@ package eventstore
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -162,6 +167,293 @@ func (s *Suite) TestRateLimit() {
 	}
 }
 
+func (s *Suite) TestAddMany() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	var events []Event
+	for i := 0; i < 10; i++ {
+		events = append(events, Event{
+			Timestamp:   Now().Add(time.Duration(i) * time.Second),
+			Description: EventDescription{Details: map[string]interface{}{"i": i}, Type: "rate_limit_check"},
+		})
+		events = append(events, Event{
+			Timestamp:   Now().Add(time.Duration(i) * time.Second),
+			Description: EventDescription{Details: map[string]interface{}{"i": i}, Type: "OffloadedRecording"},
+		})
+	}
+	s.NoError(s.store.AddMany(events))
+
+	// 5 rate_limit_check events + 1 rate limit event + 10 whitelisted events.
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(5+1+10, len(keys))
+	counts := map[string]int{}
+	for _, key := range keys {
+		eventBytes, err := s.store.Get(key)
+		s.NoError(err)
+		event := &Event{}
+		s.NoError(json.Unmarshal(eventBytes, event))
+		counts[event.Description.Type]++
+	}
+	s.Equal(map[string]int{"rate_limit_check": 5, "rateLimit": 1, "OffloadedRecording": 10}, counts)
+}
+
+func (s *Suite) TestConfiguredRateLimits() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	s.store.SetRateLimits(RateLimits{
+		Types: map[string]RateLimit{
+			"systemError":        {Window: 10 * time.Minute, Burst: 2},
+			"OffloadedRecording": {Burst: 3},
+		},
+	})
+	add := func(eventType string, count int, gap time.Duration) {
+		var events []Event
+		for i := 0; i < count; i++ {
+			events = append(events, Event{
+				Timestamp:   Now().Add(time.Duration(i) * gap),
+				Description: EventDescription{Type: eventType},
+			})
+		}
+		s.NoError(s.store.AddMany(events))
+	}
+	add("systemError", 10, time.Minute)
+	add("OffloadedRecording", 10, time.Second)
+	add("StartedRecording", 10, time.Second)
+	add("other", 10, 10*time.Second)
+	add("slow", 10, 4*time.Minute)
+
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	counts := map[string]int{}
+	for _, key := range keys {
+		eventBytes, err := s.store.Get(key)
+		s.NoError(err)
+		event := &Event{}
+		s.NoError(json.Unmarshal(eventBytes, event))
+		counts[event.Description.Type]++
+	}
+	s.Equal(map[string]int{
+		"systemError":        2,
+		"OffloadedRecording": 3,
+		"StartedRecording":   10,
+		"other":              5,
+		"slow":               10,
+		"rateLimit":          3,
+	}, counts)
+}
+
+func (s *Suite) TestRateLimitKeyFields() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	s.store.SetRateLimits(RateLimits{
+		Types: map[string]RateLimit{
+			"sensor":      {Burst: 2, KeyFields: []string{"id", "kind"}},
+			"systemError": {KeyFields: []string{"unitName"}},
+		},
+	})
+	add := func(eventType string, details map[string]interface{}, count int) {
+		var events []Event
+		for i := 0; i < count; i++ {
+			events = append(events, Event{
+				Timestamp:   Now().Add(time.Duration(i) * time.Second),
+				Description: EventDescription{Type: eventType, Details: details},
+			})
+		}
+		s.NoError(s.store.AddMany(events))
+	}
+	countEvents := func(filter Filter) int {
+		events, err := s.store.Query(filter)
+		s.NoError(err)
+		return len(events)
+	}
+
+	add("systemError", map[string]interface{}{"unitName": "noisy.service"}, 20)
+	add("systemError", map[string]interface{}{"unitName": "other.service"}, 3)
+	add("systemError", nil, 3)
+	s.Equal(5, countEvents(Filter{Types: []string{"systemError"}, Details: map[string]interface{}{"unitName": "noisy.service"}}))
+	s.Equal(3, countEvents(Filter{Types: []string{"systemError"}, Details: map[string]interface{}{"unitName": "other.service"}}))
+	s.Equal(5+3+3, countEvents(Filter{Types: []string{"systemError"}}))
+
+	add("sensor", map[string]interface{}{"id": 1, "kind": "a"}, 5)
+	add("sensor", map[string]interface{}{"id": 1, "kind": "b"}, 5)
+	add("sensor", map[string]interface{}{"id": 2, "kind": "a"}, 5)
+	s.Equal(6, countEvents(Filter{Types: []string{"sensor"}}))
+
+	events, err := s.store.Query(Filter{Types: []string{"rateLimit"}})
+	s.NoError(err)
+	s.Equal(4, len(events))
+	s.Equal("systemError", events[0].Event.Description.Details["rate_limited_event"])
+	s.Equal(map[string]interface{}{"unitName": "noisy.service"}, events[0].Event.Description.Details["rate_limited_fields"])
+
+	// Without key fields a type has one bucket.
+	s.store.SetRateLimits(RateLimits{})
+	add("systemError", map[string]interface{}{"unitName": "third.service"}, 3)
+	add("systemError", map[string]interface{}{"unitName": "fourth.service"}, 3)
+	s.Equal(5+3+3+5, countEvents(Filter{Types: []string{"systemError"}}))
+}
+
+func (s *Suite) TestRateLimitsPersist() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	add := func(eventType string, start time.Time, count int) {
+		for i := 0; i < count; i++ {
+			s.NoError(s.store.Add(&Event{
+				Timestamp:   start.Add(time.Duration(i) * time.Second),
+				Description: EventDescription{Type: eventType},
+			}))
+		}
+	}
+	countType := func(eventType string) int {
+		events, err := s.store.Query(Filter{Types: []string{eventType}})
+		s.NoError(err)
+		return len(events)
+	}
+	reopen := func() {
+		s.store.Close()
+		s.store = s.openStore()
+	}
+
+	// Restarting part way through a burst doesn't refill the bucket.
+	now := time.Now()
+	add("a", now, 3)
+	reopen()
+	add("a", now.Add(3*time.Second), 5)
+	s.Equal(5, countType("a"))
+	s.Equal(1, countType("rateLimit"))
+
+	// Suppressed events are still counted after a restart.
+	reopen()
+	add("a", now.Add(10*time.Second), 2)
+	reopen()
+	s.NoError(s.store.FlushRateLimitSummaries(now.Add(time.Hour)))
+	events, err := s.store.Query(Filter{Types: []string{"rateLimitSummary"}})
+	s.NoError(err)
+	s.Require().Equal(1, len(events))
+	s.Equal(float64(5), events[0].Event.Description.Details["suppressed"])
+
+	s.Empty(s.rateLimitKeys(), "summarised buckets have refilled so are discarded")
+
+	// Buckets that have refilled are discarded.
+	add("b", now.Add(-time.Hour), 2)
+	add("c", now, 2)
+	reopen()
+	s.Equal([]string{"c"}, s.rateLimitKeys())
+}
+
+func (s *Suite) TestRateLimitsRolledBack() {
+	s.store.SetRateLimits(RateLimits{Types: map[string]RateLimit{"a": {Window: time.Hour, Burst: 2}}})
+	start := Now()
+	event := func(i int) Event {
+		return Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Second),
+			Description: EventDescription{Type: "a", Details: map[string]interface{}{"i": i}},
+		}
+	}
+
+	// An add that fails doesn't use up tokens.
+	bad := Event{Timestamp: start, Description: EventDescription{Type: "b", Details: map[string]interface{}{"x": math.Inf(1)}}}
+	s.Error(s.store.AddMany([]Event{event(0), event(1), bad}))
+	s.Empty(s.rateLimitKeys())
+
+	s.NoError(s.store.AddMany([]Event{event(2), event(3), event(4)}))
+	events, err := s.store.Query(Filter{Types: []string{"a"}})
+	s.NoError(err)
+	s.Equal(2, len(events))
+	s.Equal([]string{"a"}, s.rateLimitKeys())
+}
+
+func (s *Suite) rateLimitKeys() []string {
+	var keys []string
+	s.NoError(s.store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rateLimitsBucketName).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}))
+	return keys
+}
+
+func (s *Suite) TestAddWithID() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	var ids []uint64
+	for i := 0; i < 6; i++ {
+		id, err := s.store.AddWithID(&Event{
+			Timestamp:   Now().Add(time.Duration(i) * time.Second),
+			Description: EventDescription{Type: "type1", Details: map[string]interface{}{"i": i}},
+		})
+		s.NoError(err)
+		ids = append(ids, id)
+	}
+	s.Zero(ids[5], "rate limited event shouldn't have an id")
+	for i, id := range ids[:5] {
+		eventBytes, err := s.store.Get(id)
+		s.NoError(err)
+		event := &Event{}
+		s.NoError(json.Unmarshal(eventBytes, event))
+		s.Equal(float64(i), event.Description.Details["i"])
+	}
+	s.NoError(s.store.Delete(ids[0]))
+	_, err := s.store.Get(ids[0])
+	s.Error(err)
+}
+
+func (s *Suite) TestAddIdempotent() {
+	event := &Event{
+		Timestamp:   Now(),
+		Description: EventDescription{Type: "versionData", Details: map[string]interface{}{"a": "1"}},
+	}
+	id, err := s.store.AddIdempotent(event, "key1")
+	s.NoError(err)
+	s.NotZero(id)
+	for i := 0; i < 10; i++ {
+		repeatID, err := s.store.AddIdempotent(event, "key1")
+		s.NoError(err)
+		s.Equal(id, repeatID)
+	}
+	otherID, err := s.store.AddIdempotent(event, "key2")
+	s.NoError(err)
+	s.NotEqual(id, otherID)
+
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(2, len(keys), "repeats shouldn't be added or rate limited")
+
+	// Keys are forgotten after a day.
+	s.NoError(s.store.db.Update(func(tx *bolt.Tx) error {
+		return putIdempotencyKey(tx, "key1", id, time.Now().Add(-25*time.Hour))
+	}))
+	newID, err := s.store.AddIdempotent(event, "key1")
+	s.NoError(err)
+	s.NotEqual(id, newID)
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(3, len(keys))
+}
+
+func (s *Suite) TestPruneIdempotencyKeys() {
+	now := time.Now()
+	s.NoError(s.store.db.Update(func(tx *bolt.Tx) error {
+		if err := putIdempotencyKey(tx, "old", 1, now.Add(-25*time.Hour)); err != nil {
+			return err
+		}
+		return putIdempotencyKey(tx, "recent", 2, now.Add(-time.Hour))
+	}))
+	s.NoError(s.store.PruneIdempotencyKeys(now))
+	s.NoError(s.store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucketName)
+		s.Nil(bucket.Get([]byte("old")), "expired keys should be removed")
+		s.NotNil(bucket.Get([]byte("recent")))
+		return nil
+	}))
+}
+
 func (s *Suite) TestNoRateLimit() {
 	getNodegroupFunc = func() (string, error) {
 		return "the_nodegroup", nil
@@ -256,11 +548,14 @@ func (s *Suite) TestRateLimitThenNoRateLimit() {
 	// Test GetKeys
 	keys, err := s.store.GetKeys()
 	s.NoError(err, "error returned when getting all keys")
-	// Check 10 events + 1 rate limit event
-	s.Equal(11, len(keys), "error with number of keys returned")
+	// The bucket of 5 tokens is used up by the 7th event, a token is
+	// regained every 3 minutes so 1 of the next 5 is let through. Check 13
+	// events + 1 rate limit event + 1 summary of the 4 suppressed events.
+	s.Equal(15, len(keys), "error with number of keys returned")
 
 	// Check that there was a rate limit event
 	rateLimitEvent := false
+	var summary *Event
 	for _, key := range keys {
 		eventBytes, err := s.store.Get(key)
 		s.NoError(err)
@@ -269,10 +564,67 @@ func (s *Suite) TestRateLimitThenNoRateLimit() {
 		if event.Description.Type == "rateLimit" {
 			rateLimitEvent = true
 		}
+		if event.Description.Type == "rateLimitSummary" {
+			summary = event
+		}
 	}
 	if !rateLimitEvent {
 		s.Fail("Rate limit event not found")
 	}
+	s.Require().NotNil(summary, "Rate limit summary event not found")
+	s.Equal(float64(4), summary.Description.Details["suppressed"])
+	s.Equal(times[7].UTC().Format(time.RFC3339Nano), summary.Description.Details["from"])
+	s.Equal(times[11].UTC().Format(time.RFC3339Nano), summary.Description.Details["to"])
+	s.Equal(3, len(summary.Description.Details["samples"].([]interface{})))
+}
+
+func (s *Suite) TestFlushRateLimitSummaries() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	start := Now()
+	for i := 0; i < 8; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Second),
+			Description: EventDescription{Details: map[string]interface{}{"i": i}, Type: "rate_limit_check"},
+		}))
+	}
+
+	countType := func(eventType string) int {
+		events, err := s.store.Query(Filter{Types: []string{eventType}})
+		s.NoError(err)
+		return len(events)
+	}
+	s.Equal(5, countType("rate_limit_check"))
+	s.Equal(1, countType("rateLimit"))
+
+	// Not refilled yet. Buckets that have refilled are discarded.
+	s.NoError(s.store.Add(&Event{
+		Timestamp:   start,
+		Description: EventDescription{Type: "quiet"},
+	}))
+	s.NoError(s.store.FlushRateLimitSummaries(start.Add(10 * time.Minute)))
+	s.Equal(0, countType("rateLimitSummary"))
+	s.Equal([]string{"rate_limit_check"}, s.rateLimitKeys())
+
+	s.NoError(s.store.FlushRateLimitSummaries(start.Add(time.Hour)))
+	events, err := s.store.Query(Filter{Types: []string{"rateLimitSummary"}})
+	s.NoError(err)
+	s.Require().Equal(1, len(events))
+	details := events[0].Event.Description.Details
+	s.Equal(float64(3), details["suppressed"])
+	s.Equal("rate_limit_check", details["rate_limited_event"])
+	s.Equal(severityWarning, details[severityKey])
+	s.Equal([]interface{}{
+		map[string]interface{}{"i": float64(5)},
+		map[string]interface{}{"i": float64(6)},
+		map[string]interface{}{"i": float64(7)},
+	}, details["samples"])
+
+	// The summary is only made once.
+	s.NoError(s.store.FlushRateLimitSummaries(start.Add(2 * time.Hour)))
+	s.Equal(1, countType("rateLimitSummary"))
+	s.Empty(s.rateLimitKeys())
 }
 
 func (s *Suite) TestRateLimitWhiteList() {
@@ -333,6 +685,706 @@ func (s *Suite) TestRateLimitWhiteList() {
 	}
 }
 
+func (s *Suite) TestMigrateLegacyEvents() {
+	time1 := Now()
+	time2 := Now().Add(time.Second)
+	legacy := []byte(`{"description":{"type":"legacy1","details":{"file":"abc"}}}`)
+	s.NoError(s.store.Queue(legacy, time1))
+	s.NoError(s.store.Queue(legacy, time2))
+	s.NoError(s.store.Queue([]byte("not json"), time1))
+
+	// Reopening a store from before the migration runs it.
+	s.store.Close()
+	s.setSchemaVersion(0)
+	s.store = s.openStore()
+
+	legacyEvents, err := s.store.All()
+	s.NoError(err)
+	s.Empty(legacyEvents, "legacy events should have been discarded")
+
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(3, len(keys))
+	times := map[int64]bool{}
+	for _, key := range keys {
+		eventBytes, err := s.store.Get(key)
+		s.NoError(err)
+		event := &Event{}
+		s.NoError(json.Unmarshal(eventBytes, event))
+		if event.Description.Type == "legacy1" {
+			s.Equal(map[string]interface{}{"file": "abc"}, event.Description.Details)
+			times[event.Timestamp.UnixNano()] = true
+		} else {
+			s.Equal("legacyEvent", event.Description.Type)
+			s.Equal("not json", event.Description.Details["raw"])
+		}
+	}
+	s.Equal(map[int64]bool{time1.UnixNano(): true, time2.UnixNano(): true}, times)
+
+	// The migration should only run once.
+	s.NoError(s.store.Queue(legacy, time1))
+	s.store.Close()
+	s.store = s.openStore()
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(3, len(keys))
+}
+
+func (s *Suite) TestMigrateUnreadableLegacyEvents() {
+	s.store.Close()
+	db, err := bolt.Open(filepath.Join(s.tempDir, "store.db"), 0600, nil)
+	s.Require().NoError(err)
+	s.Require().NoError(db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(oldBucketName).Put([]byte(`{"description":{"type":"bad"}}`), []byte{1})
+	}))
+	db.Close()
+
+	// Records that can't be read are quarantined with their attempts kept
+	// as legacy attempts.
+	s.setSchemaVersion(0)
+	s.store = s.openStore()
+
+	legacyEvents, err := s.store.All()
+	s.NoError(err)
+	s.Empty(legacyEvents, "unreadable legacy events shouldn't be left behind")
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+	quarantined, err := s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Require().Equal(1, len(quarantined))
+	q, err := s.store.GetQuarantined(quarantined[0])
+	s.NoError(err)
+	s.Equal("legacyEvent", q.Event.Description.Type)
+	s.Equal(`{"description":{"type":"bad"}}`, q.Event.Description.Details["raw"])
+	s.Equal("AQ==", q.Event.Description.Details["record"])
+	s.Contains(q.Attempts[legacyAttempts].LastError, "unsupported version")
+	s.NoError(s.store.DeleteQuarantined(quarantined[0]))
+	a, err := s.store.GetAttempts(legacyAttempts, quarantined[0])
+	s.NoError(err)
+	s.Equal(Attempts{}, a)
+}
+
+func (s *Suite) TestLimitEvictsBySeverity() {
+	s.store.SetLimits(Limits{MaxEvents: 10})
+	start := Now()
+	add := func(i int, severity string) {
+		details := map[string]interface{}{"i": i}
+		if severity != "" {
+			details[severityKey] = severity
+		}
+		s.NoError(s.store.Add(&Event{
+			// Spaced out so they aren't rate limited.
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "type" + severity, Details: details},
+		}))
+	}
+	for i := 0; i < 3; i++ {
+		add(i, severityError)
+	}
+	for i := 3; i < 6; i++ {
+		add(i, severityWarning)
+	}
+	for i := 6; i < 10; i++ {
+		add(i, "")
+	}
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(10, len(keys), "no events should be evicted before the limit")
+
+	// Going over the limit evicts the info events first, down to 90% of
+	// the limit including the eventsDropped event.
+	add(10, "")
+	types := map[string]int{}
+	var dropped *Event
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	for _, key := range keys {
+		eventBytes, err := s.store.Get(key)
+		s.NoError(err)
+		event := &Event{}
+		s.NoError(json.Unmarshal(eventBytes, event))
+		types[event.Description.Type]++
+		if event.Description.Type == "eventsDropped" {
+			dropped = event
+		}
+	}
+	s.Equal(map[string]int{"typeerror": 3, "typewarning": 3, "type": 2, "eventsDropped": 1}, types)
+	s.Require().NotNil(dropped)
+	s.Equal(float64(3), dropped.Description.Details["count"])
+	s.Equal(map[string]interface{}{"type": float64(3)}, dropped.Description.Details["types"])
+	s.Equal(start.Add(6*time.Hour).Format(time.RFC3339Nano), dropped.Description.Details["from"])
+	s.Equal(start.Add(8*time.Hour).Format(time.RFC3339Nano), dropped.Description.Details["to"])
+}
+
+func (s *Suite) TestLimitBySize() {
+	s.store.SetLimits(Limits{MaxBytes: 4096})
+	start := Now()
+	for i := 0; i < 100; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "big", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+	var size int
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	for _, key := range keys {
+		eventBytes, err := s.store.Get(key)
+		s.NoError(err)
+		size += len(eventBytes) + 8
+	}
+	s.LessOrEqual(size, 4096)
+}
+
+func (s *Suite) TestLimitTinySize() {
+	// Smaller than an eventsDropped event plus room to evict down to.
+	s.store.SetLimits(Limits{MaxBytes: 500})
+	start := Now()
+	for i := 0; i < 20; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "small", Details: map[string]interface{}{"i": i}},
+		}))
+
+		// The new event is kept and earlier eventsDropped events are
+		// folded into the latest rather than evicting everything else.
+		keys, err := s.store.GetKeys()
+		s.NoError(err)
+		kept := map[float64]bool{}
+		var dropped []*Event
+		for _, key := range keys {
+			eventBytes, err := s.store.Get(key)
+			s.NoError(err)
+			event := &Event{}
+			s.NoError(json.Unmarshal(eventBytes, event))
+			if event.Description.Type == EventsDroppedType {
+				dropped = append(dropped, event)
+			} else {
+				kept[event.Description.Details["i"].(float64)] = true
+			}
+		}
+		s.True(kept[float64(i)], "event %d should be kept", i)
+		s.LessOrEqual(len(dropped), 1)
+		if len(dropped) == 1 {
+			details := dropped[0].Description.Details
+			s.Equal(float64(i+1-len(kept)), details["count"])
+			s.Equal(map[string]interface{}{"small": float64(i + 1 - len(kept))}, details["types"])
+			s.Equal(start.Format(time.RFC3339Nano), details["from"])
+		}
+	}
+}
+
+func (s *Suite) TestStoredSize() {
+	check := func() {
+		s.NoError(s.store.db.Update(func(tx *bolt.Tx) error {
+			count, size, err := storedSize(tx)
+			s.NoError(err)
+			qCount, qSize, err := quarantinedSize(tx)
+			s.NoError(err)
+			s.NoError(countStoredEvents(tx))
+			wantCount, wantSize, err := storedSize(tx)
+			s.NoError(err)
+			s.Equal(wantCount, count)
+			s.Equal(wantSize, size)
+			wantCount, wantSize, err = quarantinedSize(tx)
+			s.NoError(err)
+			s.Equal(wantCount, qCount)
+			s.Equal(wantSize, qSize)
+			return nil
+		}))
+	}
+	check()
+	for i := 0; i < 5; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   Now(),
+			Description: EventDescription{Type: "sized", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+	check()
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.NoError(s.store.Delete(keys[0]))
+	check()
+	s.NoError(s.store.RegisterDestination("api"))
+	s.NoError(s.store.Quarantine("api", keys[1:3]))
+	check()
+	_, err = s.store.Replay(keys[1])
+	s.NoError(err)
+	check()
+	s.NoError(s.store.DeleteQuarantined(keys[2]))
+	check()
+}
+
+func (s *Suite) TestLimitEvictsQuarantinedFirst() {
+	s.NoError(s.store.RegisterDestination("api"))
+	start := Now()
+	for i := 0; i < 8; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "rejected", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.NoError(s.store.Quarantine("api", keys))
+	quarantined, err := s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Equal(keys, quarantined)
+
+	// Quarantined events count towards the limits and are evicted first.
+	s.store.SetLimits(Limits{MaxEvents: 10})
+	for i := 0; i < 3; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "new", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+	quarantined, err = s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Equal(keys[3:], quarantined, "the oldest quarantined events should be evicted")
+	pending, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Len(pending, 4, "the new events and the eventsDropped event should be kept")
+}
+
+func (s *Suite) TestStats() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	stats, err := s.store.Stats()
+	s.NoError(err)
+	s.Empty(stats.Pending)
+	s.True(stats.OldestPending.IsZero())
+
+	start := Now()
+	for i := 0; i < 3; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i-3) * time.Hour),
+			Description: EventDescription{Type: "hourly", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+	for i := 0; i < 7; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start,
+			Description: EventDescription{Type: "noisy", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+
+	stats, err = s.store.Stats()
+	s.NoError(err)
+	s.Equal(map[string]int{"hourly": 3, "noisy": 5, "rateLimit": 1}, stats.Pending)
+	s.True(stats.OldestPending.Equal(start.Add(-3*time.Hour)), stats.OldestPending)
+	s.Equal(map[string]int{"noisy": 2}, stats.RateLimited)
+	s.Positive(stats.DBSize)
+}
+
+type fakeNotifier struct {
+	added   []uint64
+	types   []string
+	dropped map[string]int
+}
+
+func (n *fakeNotifier) EventAdded(key uint64, event *Event) {
+	n.added = append(n.added, key)
+	n.types = append(n.types, event.Description.Type)
+}
+
+func (n *fakeNotifier) EventsDropped(reason string, count int) {
+	if n.dropped == nil {
+		n.dropped = map[string]int{}
+	}
+	n.dropped[reason] += count
+}
+
+func (s *Suite) TestNotifier() {
+	getNodegroupFunc = func() (string, error) {
+		return "the_nodegroup", nil
+	}
+	n := &fakeNotifier{}
+	s.store.SetNotifier(n)
+
+	var events []Event
+	for i := 0; i < 7; i++ {
+		events = append(events, Event{
+			Timestamp:   Now(),
+			Description: EventDescription{Type: "noisy", Details: map[string]interface{}{"i": i}},
+		})
+	}
+	s.NoError(s.store.AddMany(events))
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(keys, n.added)
+	s.Equal([]string{"noisy", "noisy", "noisy", "noisy", "noisy", "rateLimit"}, n.types)
+	s.Equal(map[string]int{DroppedRateLimit: 2}, n.dropped)
+
+	// An event evicted by the limits in the same transaction it was added
+	// in isn't reported as added.
+	n = &fakeNotifier{}
+	s.store.SetNotifier(n)
+	s.store.SetLimits(Limits{MaxEvents: 5})
+	s.NoError(s.store.Add(&Event{
+		Timestamp:   Now().Add(-time.Hour),
+		Description: EventDescription{Type: "old", Details: map[string]interface{}{}},
+	}))
+	s.Equal([]string{"eventsDropped"}, n.types)
+	s.Equal(map[string]int{DroppedLimits: 4}, n.dropped)
+}
+
+func (s *Suite) TestQuarantineAndReplay() {
+	s.NoError(s.store.RegisterDestination("api"))
+	s.NoError(s.store.RegisterDestination("sidekick"))
+	s.NoError(s.store.Add(&Event{
+		Timestamp:   Now(),
+		Description: EventDescription{Type: "bad", Details: map[string]interface{}{"file": "abc"}},
+	}))
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Require().Equal(1, len(keys))
+	key := keys[0]
+
+	attempts, err := s.store.RecordFailure("api", keys, errors.New("timeout"), false)
+	s.NoError(err)
+	s.Equal(1, attempts[key].Count)
+	s.Equal(0, attempts[key].PermanentFailures)
+	attempts, err = s.store.RecordFailure("api", keys, errors.New("bad request"), true)
+	s.NoError(err)
+	s.Equal(2, attempts[key].Count)
+	s.Equal(1, attempts[key].PermanentFailures)
+	s.Equal("bad request", attempts[key].LastError)
+	a, err := s.store.GetAttempts("sidekick", key)
+	s.NoError(err)
+	s.Equal(Attempts{}, a, "attempts should be kept per destination")
+
+	// Quarantining only stops the event going to that destination.
+	s.NoError(s.store.Quarantine("api", keys))
+	pending, err := s.store.PendingFor("api")
+	s.NoError(err)
+	s.Empty(pending)
+	pending, err = s.store.PendingFor("sidekick")
+	s.NoError(err)
+	s.Equal([]uint64{key}, pending)
+	quarantined, err := s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Empty(quarantined)
+
+	// It's moved into quarantine once the other destinations have it.
+	s.NoError(s.store.MarkDelivered("sidekick", keys))
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+	quarantined, err = s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Equal([]uint64{key}, quarantined)
+	q, err := s.store.GetQuarantined(key)
+	s.NoError(err)
+	s.Equal("bad", q.Event.Description.Type)
+	s.Equal(2, q.Attempts["api"].Count)
+	s.Len(q.Attempts, 1)
+
+	// Replaying only sends it to the destinations that quarantined it.
+	newKey, err := s.store.Replay(key)
+	s.NoError(err)
+	s.Greater(newKey, key, "replayed events should get a new key")
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Equal([]uint64{newKey}, keys)
+	pending, err = s.store.PendingFor("api")
+	s.NoError(err)
+	s.Equal([]uint64{newKey}, pending)
+	pending, err = s.store.PendingFor("sidekick")
+	s.NoError(err)
+	s.Empty(pending)
+	quarantined, err = s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Empty(quarantined)
+	a, err = s.store.GetAttempts("api", newKey)
+	s.NoError(err)
+	s.Equal(Attempts{}, a, "replaying should clear the attempts")
+	a, err = s.store.GetAttempts("api", key)
+	s.NoError(err)
+	s.Equal(Attempts{}, a)
+
+	// Delivering it to the destination deletes it.
+	s.NoError(s.store.MarkDelivered("api", keys))
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+}
+
+func (s *Suite) TestDeliveryTracking() {
+	for i := 0; i < 3; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   Now().Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "type1", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Require().Equal(3, len(keys))
+
+	s.Error(s.store.MarkDelivered("api", keys), "destination should need registering")
+	s.NoError(s.store.RegisterDestination("api"))
+	s.NoError(s.store.RegisterDestination("sidekick"))
+	destinations, err := s.store.Destinations()
+	s.NoError(err)
+	s.ElementsMatch([]string{"api", "sidekick"}, destinations)
+
+	s.NoError(s.store.MarkDelivered("api", keys[:2]))
+	pending, err := s.store.PendingFor("api")
+	s.NoError(err)
+	s.Equal(keys[2:], pending)
+	pending, err = s.store.PendingFor("sidekick")
+	s.NoError(err)
+	s.Equal(keys, pending)
+
+	// Only events every destination has are deleted.
+	s.NoError(s.store.MarkDelivered("sidekick", keys[1:]))
+	remaining, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal([]uint64{keys[0], keys[2]}, remaining)
+
+	// Removing a destination deletes events the others all have.
+	s.NoError(s.store.UnregisterDestination("sidekick"))
+	remaining, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Equal([]uint64{keys[2]}, remaining)
+}
+
+func (s *Suite) TestQuery() {
+	start := Now()
+	for i := 0; i < 24; i++ {
+		details := map[string]interface{}{"i": i, "unitName": fmt.Sprintf("unit%d", i%3)}
+		if i%4 == 0 {
+			details[severityKey] = severityError
+		}
+		eventType := []string{"a", "b", "c"}[i%3]
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   start.Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: eventType, Details: details},
+		}))
+	}
+
+	query := func(filter Filter) []int {
+		events, err := s.store.Query(filter)
+		s.Require().NoError(err)
+		is := []int{}
+		for _, e := range events {
+			is = append(is, int(e.Event.Description.Details["i"].(float64)))
+		}
+		return is
+	}
+
+	s.Equal(24, len(query(Filter{})))
+	s.Equal([]int{0, 3, 6, 9, 12, 15, 18, 21}, query(Filter{Types: []string{"a"}}))
+	s.Equal([]int{0, 1, 3, 4, 6, 7}, query(Filter{Types: []string{"b", "a"}, Limit: 6}))
+	s.Equal([]int{6, 7, 8, 9}, query(Filter{From: start.Add(6 * time.Hour), To: start.Add(10 * time.Hour)}))
+	s.Equal([]int{12, 15}, query(Filter{Types: []string{"a"}, From: start.Add(8 * time.Hour), Offset: 1, Limit: 2}))
+	s.Equal([]int{0, 4, 8, 12, 16, 20}, query(Filter{Severity: severityError}))
+	s.Equal([]int{1, 2, 3}, query(Filter{Severity: severityInfo, Limit: 3}))
+	s.Equal([]int{4, 16}, query(Filter{Severity: severityError, Details: map[string]interface{}{"unitName": "unit1"}}))
+	s.Equal([]int{5}, query(Filter{Details: map[string]interface{}{"i": 5}}))
+	s.Equal([]int{}, query(Filter{Types: []string{"d"}}))
+
+	// Deleted and quarantined events are removed from the indexes.
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	for _, key := range keys {
+		if key%2 == 0 {
+			s.NoError(s.store.Delete(key))
+		}
+	}
+	s.Equal([]int{0, 6, 12, 18}, query(Filter{Types: []string{"a"}}))
+	s.NoError(s.store.RegisterDestination("api"))
+	s.NoError(s.store.Quarantine("api", []uint64{1}))
+	s.Equal([]int{6, 12, 18}, query(Filter{Types: []string{"a"}}))
+	_, err = s.store.Replay(1)
+	s.NoError(err)
+	s.Equal([]int{0, 6, 12, 18}, query(Filter{Types: []string{"a"}}))
+}
+
+func (s *Suite) TestIndexConsistency() {
+	rng := rand.New(rand.NewSource(1))
+	types := []string{"a", "b", "OffloadedRecording", "c/d"}
+	s.store.SetLimits(Limits{MaxEvents: 150})
+	s.NoError(s.store.RegisterDestination("api"))
+	start := Now()
+
+	var quarantined []uint64
+	for i := 0; i < 300; i++ {
+		keys, err := s.store.GetKeys()
+		s.Require().NoError(err)
+		switch op := rng.Intn(10); {
+		case op < 5 || len(keys) == 0:
+			var events []Event
+			for j := rng.Intn(5) + 1; j > 0; j-- {
+				events = append(events, Event{
+					// Times can repeat and go before 1970.
+					Timestamp: start.Add(time.Duration(rng.Intn(200)-100) * 24 * 365 * time.Hour),
+					Description: EventDescription{
+						Type:    types[rng.Intn(len(types))],
+						Details: map[string]interface{}{"n": rng.Intn(3)},
+					},
+				})
+			}
+			s.Require().NoError(s.store.AddMany(events))
+		case op < 7:
+			s.Require().NoError(s.store.Delete(keys[rng.Intn(len(keys))]))
+		case op < 8:
+			key := keys[rng.Intn(len(keys))]
+			s.Require().NoError(s.store.Quarantine("api", []uint64{key}))
+			quarantined = append(quarantined, key)
+		case op < 9 && len(quarantined) > 0:
+			n := rng.Intn(len(quarantined))
+			_, err := s.store.Replay(quarantined[n])
+			s.Require().NoError(err)
+			quarantined = append(quarantined[:n], quarantined[n+1:]...)
+		default:
+			s.Require().NoError(s.store.MarkDelivered("api", keys[:rng.Intn(len(keys))]))
+		}
+		s.Require().NoError(s.store.CheckIndexes(), "after step %d", i)
+	}
+
+	// Query results match reading every event.
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	want := map[string]int{}
+	for _, key := range keys {
+		eventBytes, err := s.store.Get(key)
+		s.NoError(err)
+		event := &Event{}
+		s.NoError(json.Unmarshal(eventBytes, event))
+		if !event.Timestamp.Before(start) {
+			want[event.Description.Type]++
+		}
+	}
+	for _, t := range append(types, "rateLimit", "eventsDropped") {
+		events, err := s.store.Query(Filter{Types: []string{t}, From: start})
+		s.NoError(err)
+		s.Equal(want[t], len(events), t)
+		for i := 1; i < len(events); i++ {
+			s.False(events[i].Event.Timestamp.Before(events[i-1].Event.Timestamp))
+		}
+	}
+}
+
+func (s *Suite) TestRebuildIndexes() {
+	for i := 0; i < 20; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   Now().Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "type1"},
+		}))
+	}
+	s.NoError(s.store.CheckIndexes())
+
+	clearIndex := func(db *bolt.DB) {
+		s.Require().NoError(db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(timeIndexBucketName); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucket(timeIndexBucketName)
+			return err
+		}))
+	}
+	clearIndex(s.store.db)
+	s.Error(s.store.CheckIndexes())
+	s.NoError(s.store.RebuildIndexes())
+	s.NoError(s.store.CheckIndexes())
+
+	// Opening a store only checks the indexes if they weren't built by
+	// this index version.
+	clearIndex(s.store.db)
+	s.store.Close()
+	s.store = s.openStore()
+	s.Error(s.store.CheckIndexes())
+	s.Require().NoError(s.store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucketName).Delete(indexVersionKey)
+	}))
+	s.store.Close()
+	s.store = s.openStore()
+	s.NoError(s.store.CheckIndexes())
+	events, err := s.store.Query(Filter{})
+	s.NoError(err)
+	s.Equal(20, len(events))
+}
+
+func (s *Suite) TestGetSinceAndAck() {
+	for i := 0; i < 300; i++ {
+		s.NoError(s.store.Add(&Event{
+			Timestamp:   Now().Add(time.Duration(i) * time.Hour),
+			Description: EventDescription{Type: "type1", Details: map[string]interface{}{"i": i}},
+		}))
+	}
+
+	// Page through all the events in order.
+	var cursor uint64
+	var got []int
+	for {
+		events, next, err := s.store.GetSince(cursor, 100)
+		s.Require().NoError(err)
+		if len(events) == 0 {
+			s.Equal(cursor, next)
+			break
+		}
+		for _, e := range events {
+			s.Greater(e.Key, cursor)
+			got = append(got, int(e.Event.Description.Details["i"].(float64)))
+		}
+		cursor = next
+	}
+	s.Equal(300, len(got))
+	for i := range got {
+		s.Equal(i, got[i])
+	}
+
+	// Acking marks events as delivered when the collector is a destination.
+	s.NoError(s.store.RegisterDestination("api"))
+	s.NoError(s.store.RegisterDestination("sidekick"))
+	s.NoError(s.store.MarkDelivered("api", []uint64{1, 2, 3, 299, 300}))
+	s.NoError(s.store.Ack("sidekick", 200))
+	cursor, err := s.store.GetCursor("sidekick")
+	s.NoError(err)
+	s.Equal(uint64(200), cursor)
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(297, len(keys))
+	pending, err := s.store.PendingFor("sidekick")
+	s.NoError(err)
+	s.Equal(100, len(pending))
+
+	// The cursor doesn't go backwards.
+	s.NoError(s.store.Ack("sidekick", 100))
+	cursor, err = s.store.GetCursor("sidekick")
+	s.NoError(err)
+	s.Equal(uint64(200), cursor)
+
+	// Replayed events come after the cursor of collectors that had them.
+	s.NoError(s.store.Quarantine("api", []uint64{250}))
+	s.NoError(s.store.Ack("sidekick", 300))
+	quarantined, err := s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Equal([]uint64{250}, quarantined)
+	newKey, err := s.store.Replay(250)
+	s.NoError(err)
+	events, _, err := s.store.GetSince(300, 100)
+	s.NoError(err)
+	s.Require().Equal(1, len(events))
+	s.Equal(newKey, events[0].Key)
+	s.Equal(249.0, events[0].Event.Description.Details["i"])
+	pending, err = s.store.PendingFor("sidekick")
+	s.NoError(err)
+	s.Empty(pending, "destinations that had the event shouldn't get it again")
+}
+
+func (s *Suite) setSchemaVersion(version uint64) {
+	db, err := bolt.Open(filepath.Join(s.tempDir, "store.db"), 0600, nil)
+	s.Require().NoError(err)
+	defer db.Close()
+	s.Require().NoError(db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucketName).Put(schemaVersionKey, uint64ToBytes(version))
+	}))
+}
+
 func TestRun(t *testing.T) {
 	suite.Run(t, new(Suite))
 }
@@ -0,0 +1,103 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Producers can give an idempotency key with an event so retrying an add,
+// after the reply to the first attempt was lost, doesn't add it twice.
+// Keys are remembered for idempotencyKeyTTL.
+const idempotencyKeyTTL = 24 * time.Hour
+
+type idempotencyRecord struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// AddIdempotent adds the event unless an event was added with the same
+// idempotency key in the last day. The key of the event is returned,
+// the original event if it's a repeat. If the event is rate limited the
+// key is 0 and the idempotency key is not remembered.
+func (s *EventStore) AddIdempotent(event *Event, idempotencyKey string) (uint64, error) {
+	return s.addEvent(event, idempotencyKey)
+}
+
+func getIdempotencyKey(tx *bolt.Tx, idempotencyKey string, now time.Time) (uint64, bool, error) {
+	bucket := tx.Bucket(idempotencyBucketName)
+	if bucket == nil {
+		return 0, false, noBucketErr(idempotencyBucketName)
+	}
+	val := bucket.Get([]byte(idempotencyKey))
+	if val == nil {
+		return 0, false, nil
+	}
+	var record idempotencyRecord
+	if err := json.Unmarshal(val, &record); err != nil {
+		return 0, false, err
+	}
+	if now.Sub(record.Time) > idempotencyKeyTTL {
+		return 0, false, nil
+	}
+	return record.ID, true, nil
+}
+
+// putIdempotencyKey remembers the key. Expired keys are ignored by
+// getIdempotencyKey and removed by PruneIdempotencyKeys.
+func putIdempotencyKey(tx *bolt.Tx, idempotencyKey string, id uint64, now time.Time) error {
+	bucket := tx.Bucket(idempotencyBucketName)
+	if bucket == nil {
+		return noBucketErr(idempotencyBucketName)
+	}
+	data, err := json.Marshal(idempotencyRecord{ID: id, Time: now})
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(idempotencyKey), data)
+}
+
+// PruneIdempotencyKeys forgets the idempotency keys that have expired by
+// now. It is done when uploading, rather than on every add, so adding
+// doesn't read every key.
+func (s *EventStore) PruneIdempotencyKeys(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucketName)
+		if bucket == nil {
+			return noBucketErr(idempotencyBucketName)
+		}
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			var record idempotencyRecord
+			if err := json.Unmarshal(v, &record); err != nil || now.Sub(record.Time) > idempotencyKeyTTL {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
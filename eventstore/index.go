@@ -0,0 +1,290 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The index buckets hold a key for each event in the id-data bucket so
+// events can be found by type, time or key without reading them all. The
+// values are empty. Timestamps and event keys are big endian so bolt
+// keeps the index keys in order.
+//
+//	type-time index: <type> 0x00 <timestamp> <event key>
+//	time index:      <timestamp> <event key>
+//	key index:       <event key>
+
+// timeKey encodes a timestamp so that the bytes sort in time order,
+// including times before 1970.
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano())^(1<<63))
+	return b
+}
+
+func timeIndexKey(t time.Time, key uint64) []byte {
+	b := timeKey(t)
+	return binary.BigEndian.AppendUint64(b, key)
+}
+
+func typePrefix(eventType string) []byte {
+	return append([]byte(eventType), 0)
+}
+
+func typeIndexKey(eventType string, t time.Time, key uint64) []byte {
+	return append(typePrefix(eventType), timeIndexKey(t, key)...)
+}
+
+func keyIndexKey(key uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, key)
+}
+
+// keyFromIndex returns the event key at the end of an index key.
+func keyFromIndex(k []byte) uint64 {
+	return binary.BigEndian.Uint64(k[len(k)-8:])
+}
+
+func indexBuckets(tx *bolt.Tx) (typeIndex, timeIndex *bolt.Bucket, err error) {
+	typeIndex = tx.Bucket(typeIndexBucketName)
+	if typeIndex == nil {
+		return nil, nil, noBucketErr(typeIndexBucketName)
+	}
+	timeIndex = tx.Bucket(timeIndexBucketName)
+	if timeIndex == nil {
+		return nil, nil, noBucketErr(timeIndexBucketName)
+	}
+	return typeIndex, timeIndex, nil
+}
+
+func keyIndexBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	keyIndex := tx.Bucket(keyIndexBucketName)
+	if keyIndex == nil {
+		return nil, noBucketErr(keyIndexBucketName)
+	}
+	return keyIndex, nil
+}
+
+func indexEvent(tx *bolt.Tx, key uint64, event *Event) error {
+	typeIndex, timeIndex, err := indexBuckets(tx)
+	if err != nil {
+		return err
+	}
+	keyIndex, err := keyIndexBucket(tx)
+	if err != nil {
+		return err
+	}
+	if err := typeIndex.Put(typeIndexKey(event.Description.Type, event.Timestamp, key), []byte{}); err != nil {
+		return err
+	}
+	if err := timeIndex.Put(timeIndexKey(event.Timestamp, key), []byte{}); err != nil {
+		return err
+	}
+	return keyIndex.Put(keyIndexKey(key), []byte{})
+}
+
+func unindexEvent(tx *bolt.Tx, key uint64, event *Event) error {
+	typeIndex, timeIndex, err := indexBuckets(tx)
+	if err != nil {
+		return err
+	}
+	keyIndex, err := keyIndexBucket(tx)
+	if err != nil {
+		return err
+	}
+	if err := typeIndex.Delete(typeIndexKey(event.Description.Type, event.Timestamp, key)); err != nil {
+		return err
+	}
+	if err := timeIndex.Delete(timeIndexKey(event.Timestamp, key)); err != nil {
+		return err
+	}
+	return keyIndex.Delete(keyIndexKey(key))
+}
+
+// unindexStored removes the index keys of a stored event. Nothing is done
+// if the event can't be read as it couldn't have been indexed.
+func unindexStored(tx *bolt.Tx, key []byte, val []byte) error {
+	if val == nil {
+		return nil
+	}
+	event := &Event{}
+	if err := json.Unmarshal(val, event); err != nil {
+		return nil
+	}
+	return unindexEvent(tx, bytesToUint64(key), event)
+}
+
+// indexVersion is recorded in the meta bucket when the indexes are built.
+// Checking the indexes reads every event, so Open only does it when the
+// recorded version doesn't match. Increase it when what is indexed changes.
+const indexVersion = 1
+
+var indexVersionKey = []byte("index-version")
+
+func setIndexVersion(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return noBucketErr(metaBucketName)
+	}
+	return meta.Put(indexVersionKey, uint64ToBytes(indexVersion))
+}
+
+// ensureIndexes checks the indexes, rebuilding them if they are wrong,
+// unless they were last built or checked by this index version.
+func ensureIndexes(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return noBucketErr(metaBucketName)
+	}
+	if val := meta.Get(indexVersionKey); val != nil && bytesToUint64(val) == indexVersion {
+		return nil
+	}
+	if err := checkIndexes(tx); err != nil {
+		log.Warnf("rebuilding event indexes: %v", err)
+		return buildIndexes(tx)
+	}
+	return setIndexVersion(tx)
+}
+
+// buildIndexes clears the index buckets and indexes every event in the
+// id-data bucket.
+func buildIndexes(tx *bolt.Tx) error {
+	for _, name := range [][]byte{typeIndexBucketName, timeIndexBucketName, keyIndexBucketName} {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return noBucketErr(idDataBucketName)
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		event := &Event{}
+		if err := json.Unmarshal(v, event); err != nil {
+			log.Errorf("failed to read event %d: %v", bytesToUint64(k), err)
+			return nil
+		}
+		return indexEvent(tx, bytesToUint64(k), event)
+	})
+	if err != nil {
+		return err
+	}
+	return setIndexVersion(tx)
+}
+
+// RebuildIndexes rebuilds the index buckets from the stored events.
+func (s *EventStore) RebuildIndexes() error {
+	return s.db.Update(buildIndexes)
+}
+
+// CheckIndexes returns an error if the index buckets don't have exactly
+// one key for each readable event.
+func (s *EventStore) CheckIndexes() error {
+	return s.db.View(checkIndexes)
+}
+
+func checkIndexes(tx *bolt.Tx) error {
+	typeIndex, timeIndex, err := indexBuckets(tx)
+	if err != nil {
+		return err
+	}
+	keyIndex, err := keyIndexBucket(tx)
+	if err != nil {
+		return err
+	}
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return noBucketErr(idDataBucketName)
+	}
+	count := 0
+	err = bucket.ForEach(func(k, v []byte) error {
+		event := &Event{}
+		if err := json.Unmarshal(v, event); err != nil {
+			return nil
+		}
+		key := bytesToUint64(k)
+		if typeIndex.Get(typeIndexKey(event.Description.Type, event.Timestamp, key)) == nil {
+			return fmt.Errorf("event %d missing from type index", key)
+		}
+		if timeIndex.Get(timeIndexKey(event.Timestamp, key)) == nil {
+			return fmt.Errorf("event %d missing from time index", key)
+		}
+		if keyIndex.Get(keyIndexKey(key)) == nil {
+			return fmt.Errorf("event %d missing from key index", key)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n := countKeys(typeIndex); n != count {
+		return fmt.Errorf("type index has %d keys for %d events", n, count)
+	}
+	if n := countKeys(timeIndex); n != count {
+		return fmt.Errorf("time index has %d keys for %d events", n, count)
+	}
+	if n := countKeys(keyIndex); n != count {
+		return fmt.Errorf("key index has %d keys for %d events", n, count)
+	}
+	return nil
+}
+
+func countKeys(bucket *bolt.Bucket) int {
+	n := 0
+	bucket.ForEach(func(k, v []byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// scanIndex returns the time index keys, <timestamp> <event key>, from
+// the index keys that start with prefix and have a timestamp in
+// [from, to). Zero times are unbounded.
+func scanIndex(bucket *bolt.Bucket, prefix []byte, from, to time.Time) [][]byte {
+	start := prefix
+	if !from.IsZero() {
+		start = append(append([]byte{}, prefix...), timeKey(from)...)
+	}
+	var end []byte
+	if !to.IsZero() {
+		end = append(append([]byte{}, prefix...), timeKey(to)...)
+	}
+	var out [][]byte
+	c := bucket.Cursor()
+	for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if end != nil && bytes.Compare(k, end) >= 0 {
+			break
+		}
+		out = append(out, append([]byte{}, k[len(prefix):]...))
+	}
+	return out
+}
@@ -0,0 +1,392 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// Severity levels as set in the event details by eventclient.
+	severityKey     = "severity"
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+
+	// When a limit is exceeded events are evicted until the store is
+	// down to this fraction of the limit so eviction doesn't happen on
+	// every add.
+	evictionLowWater = 0.9
+
+	// Room left for the eventsDropped event when evicting by size.
+	droppedEventSize = 512
+)
+
+// Limits bounds how much the event store will hold. A zero value means
+// there is no limit. MaxBytes caps the size of the stored events, their
+// keys and JSON, not the size of the database file. Bolt doesn't shrink
+// its file when events are deleted, and the file also holds the indexes
+// and other state, so it can be a few times larger than MaxBytes.
+type Limits struct {
+	MaxEvents int
+	MaxBytes  int64
+}
+
+// The number of events in the id-data and quarantine buckets and the
+// total size of their keys and values are kept in the meta bucket. They
+// are updated along with the events so checking the limits doesn't read
+// every event.
+var (
+	eventCountKey      = []byte("event-count")
+	eventBytesKey      = []byte("event-bytes")
+	quarantineCountKey = []byte("quarantine-count")
+	quarantineBytesKey = []byte("quarantine-bytes")
+)
+
+func metaSize(tx *bolt.Tx, countKey, bytesKey []byte) (int, int64, error) {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return 0, 0, noBucketErr(metaBucketName)
+	}
+	var count, size uint64
+	if val := meta.Get(countKey); val != nil {
+		count = bytesToUint64(val)
+	}
+	if val := meta.Get(bytesKey); val != nil {
+		size = bytesToUint64(val)
+	}
+	return int(count), int64(size), nil
+}
+
+func setMetaSize(tx *bolt.Tx, countKey, bytesKey []byte, count int, size int64) error {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return noBucketErr(metaBucketName)
+	}
+	if err := meta.Put(countKey, uint64ToBytes(uint64(max(count, 0)))); err != nil {
+		return err
+	}
+	return meta.Put(bytesKey, uint64ToBytes(uint64(max(size, 0))))
+}
+
+func storedSize(tx *bolt.Tx) (int, int64, error) {
+	return metaSize(tx, eventCountKey, eventBytesKey)
+}
+
+func setStoredSize(tx *bolt.Tx, count int, size int64) error {
+	return setMetaSize(tx, eventCountKey, eventBytesKey, count, size)
+}
+
+// adjustStoredSize records that events were added to or removed from the
+// id-data bucket.
+func adjustStoredSize(tx *bolt.Tx, count int, size int64) error {
+	oldCount, oldSize, err := storedSize(tx)
+	if err != nil {
+		return err
+	}
+	return setStoredSize(tx, oldCount+count, oldSize+size)
+}
+
+func quarantinedSize(tx *bolt.Tx) (int, int64, error) {
+	return metaSize(tx, quarantineCountKey, quarantineBytesKey)
+}
+
+func setQuarantinedSize(tx *bolt.Tx, count int, size int64) error {
+	return setMetaSize(tx, quarantineCountKey, quarantineBytesKey, count, size)
+}
+
+// adjustQuarantinedSize records that events were added to or removed from
+// the quarantine bucket.
+func adjustQuarantinedSize(tx *bolt.Tx, count int, size int64) error {
+	oldCount, oldSize, err := quarantinedSize(tx)
+	if err != nil {
+		return err
+	}
+	return setQuarantinedSize(tx, oldCount+count, oldSize+size)
+}
+
+// bucketSize returns the number of events in a bucket and the total size
+// of their keys and values by reading them all.
+func bucketSize(tx *bolt.Tx, name []byte) (int, int64, error) {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return 0, 0, noBucketErr(name)
+	}
+	count := 0
+	var size int64
+	bucket.ForEach(func(k, v []byte) error {
+		count++
+		size += int64(len(k) + len(v))
+		return nil
+	})
+	return count, size, nil
+}
+
+// countStoredEvents sets the number and size of the stored and
+// quarantined events by reading them all.
+func countStoredEvents(tx *bolt.Tx) error {
+	count, size, err := bucketSize(tx, idDataBucketName)
+	if err != nil {
+		return err
+	}
+	if err := setStoredSize(tx, count, size); err != nil {
+		return err
+	}
+	count, size, err = bucketSize(tx, quarantineBucketName)
+	if err != nil {
+		return err
+	}
+	return setQuarantinedSize(tx, count, size)
+}
+
+// SetLimits sets the limits of the store. Quarantined events count
+// towards the limits. When an event is added that takes the store over a
+// limit, events are evicted. Quarantined events are evicted first, then
+// info, warning and error events, oldest first. An eventsDropped event is
+// added summarising what was evicted.
+func (s *EventStore) SetLimits(limits Limits) {
+	s.limitsMux.Lock()
+	defer s.limitsMux.Unlock()
+	s.limits = limits
+}
+
+func (s *EventStore) getLimits() Limits {
+	s.limitsMux.Lock()
+	defer s.limitsMux.Unlock()
+	return s.limits
+}
+
+type storedEvent struct {
+	key         []byte
+	size        int64
+	event       Event
+	quarantined bool
+}
+
+// readEvents reads all the events in a bucket, keeping unreadable ones so
+// they can still be evicted.
+func readEvents(tx *bolt.Tx, name []byte) ([]storedEvent, error) {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return nil, noBucketErr(name)
+	}
+	var events []storedEvent
+	err := bucket.ForEach(func(k, v []byte) error {
+		e := storedEvent{
+			key:         append([]byte{}, k...),
+			size:        int64(len(k) + len(v)),
+			quarantined: bytes.Equal(name, quarantineBucketName),
+		}
+		if err := json.Unmarshal(v, &e.event); err != nil {
+			log.Errorf("failed to read event %d: %v", bytesToUint64(k), err)
+		}
+		events = append(events, e)
+		return nil
+	})
+	return events, err
+}
+
+func totalSize(events []storedEvent) (int, int64) {
+	var size int64
+	for _, e := range events {
+		size += e.size
+	}
+	return len(events), size
+}
+
+func severityRank(event *Event) int {
+	switch event.Description.Details[severityKey] {
+	case severityError:
+		return 2
+	case severityWarning:
+		return 1
+	}
+	return 0
+}
+
+// enforceLimits drops events until the store is back under its limits and
+// adds an eventsDropped event saying what was dropped.
+func (s *EventStore) enforceLimits(tx *bolt.Tx, c *changes) error {
+	limits := s.getLimits()
+	if limits.MaxEvents <= 0 && limits.MaxBytes <= 0 {
+		return nil
+	}
+	count, size, err := storedSize(tx)
+	if err != nil {
+		return err
+	}
+	qCount, qSize, err := quarantinedSize(tx)
+	if err != nil {
+		return err
+	}
+	count += qCount
+	size += qSize
+	overCount := limits.MaxEvents > 0 && count > limits.MaxEvents
+	overSize := limits.MaxBytes > 0 && size > limits.MaxBytes
+	if !overCount && !overSize {
+		return nil
+	}
+
+	targetCount := count
+	if limits.MaxEvents > 0 {
+		targetCount = max(int(float64(limits.MaxEvents)*evictionLowWater), 1) - 1
+	}
+	targetSize := size
+	if limits.MaxBytes > 0 {
+		// Tiny limits would otherwise leave nothing, or less than nothing.
+		targetSize = max(int64(float64(limits.MaxBytes)*evictionLowWater)-droppedEventSize, limits.MaxBytes/2)
+	}
+
+	quarantined, err := readEvents(tx, quarantineBucketName)
+	if err != nil {
+		return err
+	}
+	events, err := readEvents(tx, idDataBucketName)
+	if err != nil {
+		return err
+	}
+	// All the events have been read anyway so correct any drift in the totals.
+	qCount, qSize = totalSize(quarantined)
+	if err := setQuarantinedSize(tx, qCount, qSize); err != nil {
+		return err
+	}
+	count, size = totalSize(events)
+	if err := setStoredSize(tx, count, size); err != nil {
+		return err
+	}
+	count += qCount
+	size += qSize
+	sort.SliceStable(events, func(i, j int) bool {
+		// Earlier eventsDropped events go first as they are folded into
+		// the new one, so summaries don't build up and evict everything
+		// else when the limits are small.
+		di, dj := events[i].event.Description.Type == EventsDroppedType, events[j].event.Description.Type == EventsDroppedType
+		if di != dj {
+			return di
+		}
+		ri, rj := severityRank(&events[i].event), severityRank(&events[j].event)
+		if ri != rj {
+			return ri < rj
+		}
+		return events[i].event.Timestamp.Before(events[j].event.Timestamp)
+	})
+	// Quarantined events go first, oldest first by key, as they won't be
+	// uploaded unless replayed.
+	events = append(quarantined, events...)
+
+	summary := droppedSummary{types: map[string]int{}}
+	dropped := 0
+	for _, e := range events {
+		if count <= targetCount && size <= targetSize {
+			break
+		}
+		remove := deleteEvent
+		if e.quarantined {
+			remove = deleteQuarantined
+		}
+		if err := remove(tx, e.key); err != nil {
+			return err
+		}
+		count--
+		size -= e.size
+		if !e.quarantined && e.event.Description.Type == EventsDroppedType {
+			summary.merge(&e.event)
+			continue
+		}
+		dropped++
+		summary.add(&e.event)
+	}
+
+	log.Warnf("event store limits exceeded, dropped %d event%s", dropped, plural(dropped))
+	c.drop(DroppedLimits, dropped)
+	c.removeDeleted(tx)
+	droppedEvent := summary.event()
+	key, err := putEvent(tx, droppedEvent)
+	if err != nil {
+		return err
+	}
+	c.added = append(c.added, KeyedEvent{Key: key, Event: *droppedEvent})
+	return nil
+}
+
+// droppedSummary is what goes in an eventsDropped event.
+type droppedSummary struct {
+	count    int
+	types    map[string]int
+	from, to time.Time
+}
+
+func (d *droppedSummary) addTime(t time.Time) {
+	if d.from.IsZero() || t.Before(d.from) {
+		d.from = t
+	}
+	if t.After(d.to) {
+		d.to = t
+	}
+}
+
+// add records an event being dropped.
+func (d *droppedSummary) add(event *Event) {
+	d.count++
+	d.types[event.Description.Type]++
+	d.addTime(event.Timestamp)
+}
+
+// merge adds what an earlier eventsDropped event said was dropped.
+func (d *droppedSummary) merge(event *Event) {
+	details := event.Description.Details
+	if count, ok := details["count"].(float64); ok {
+		d.count += int(count)
+	}
+	if types, ok := details["types"].(map[string]interface{}); ok {
+		for t, n := range types {
+			if n, ok := n.(float64); ok {
+				d.types[t] += int(n)
+			}
+		}
+	}
+	for _, name := range []string{"from", "to"} {
+		if str, ok := details[name].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, str); err == nil && !t.IsZero() {
+				d.addTime(t)
+			}
+		}
+	}
+}
+
+func (d *droppedSummary) event() *Event {
+	return &Event{
+		Timestamp: time.Now(),
+		Description: EventDescription{
+			Type: EventsDroppedType,
+			Details: map[string]interface{}{
+				"count":     d.count,
+				"types":     d.types,
+				"from":      d.from,
+				"to":        d.to,
+				severityKey: severityWarning,
+			},
+		},
+	}
+}
@@ -0,0 +1,203 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var schemaVersionKey = []byte("schema-version")
+
+// migrations are run in order by Open. A database at schema version n
+// has had the first n migrations applied. Each migration runs in the
+// same transaction that records the new schema version so if the
+// process dies part way through it is rolled back and run again on
+// the next Open.
+var migrations = []func(tx *bolt.Tx) error{
+	migrateLegacyEvents,
+	buildIndexes,
+	countStoredEvents,
+}
+
+func migrate(db *bolt.DB) error {
+	for {
+		done := false
+		err := db.Update(func(tx *bolt.Tx) error {
+			meta := tx.Bucket(metaBucketName)
+			if meta == nil {
+				return noBucketErr(metaBucketName)
+			}
+			version := schemaVersion(meta)
+			if version >= uint64(len(migrations)) {
+				done = true
+				return nil
+			}
+			log.Printf("migrating event store to schema version %d", version+1)
+			if err := migrations[version](tx); err != nil {
+				return err
+			}
+			return meta.Put(schemaVersionKey, uint64ToBytes(version+1))
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func schemaVersion(meta *bolt.Bucket) uint64 {
+	val := meta.Get(schemaVersionKey)
+	if val == nil {
+		return 0
+	}
+	return bytesToUint64(val)
+}
+
+// migrateLegacyEvents moves events from the old events bucket, which
+// was keyed by the event details with a list of timestamps as the value,
+// into the id-data bucket with one entry per timestamp. Records with
+// timestamps that can't be read are quarantined so nothing is lost.
+func migrateLegacyEvents(tx *bolt.Tx) error {
+	oldBucket := tx.Bucket(oldBucketName)
+	if oldBucket == nil {
+		return noBucketErr(oldBucketName)
+	}
+	var migrated [][]byte
+	count := 0
+	unreadable := 0
+	cursor := oldBucket.Cursor()
+	for key, rec := cursor.First(); key != nil; key, rec = cursor.Next() {
+		timestamps, err := decodeTimestamps(rec)
+		if err != nil {
+			log.Errorf("failed to read legacy event '%s': %v", string(key), err)
+			if err := quarantineLegacyEvent(tx, key, rec, err); err != nil {
+				return err
+			}
+			unreadable++
+			migrated = append(migrated, append([]byte{}, key...))
+			continue
+		}
+		for _, event := range legacyEvents(key, timestamps) {
+			if _, err := putEvent(tx, &event); err != nil {
+				return err
+			}
+			count++
+		}
+		migrated = append(migrated, append([]byte{}, key...))
+	}
+
+	for _, key := range migrated {
+		if err := oldBucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	log.Printf("migrated %d legacy event%s", count, plural(count))
+	if unreadable > 0 {
+		log.Warnf("quarantined %d unreadable legacy event%s", unreadable, plural(unreadable))
+	}
+	return nil
+}
+
+// quarantineLegacyEvent puts a legacy record that couldn't be read into
+// quarantine as a legacyEvent with the raw details and record, with the
+// error as its last failed attempt.
+func quarantineLegacyEvent(tx *bolt.Tx, details, rec []byte, readErr error) error {
+	bucket := tx.Bucket(idDataBucketName)
+	if bucket == nil {
+		return noBucketErr(idDataBucketName)
+	}
+	quarantine := tx.Bucket(quarantineBucketName)
+	if quarantine == nil {
+		return noBucketErr(quarantineBucketName)
+	}
+	attempts := tx.Bucket(attemptsBucketName)
+	if attempts == nil {
+		return noBucketErr(attemptsBucketName)
+	}
+	legacy, err := attempts.CreateBucketIfNotExists([]byte(legacyAttempts))
+	if err != nil {
+		return err
+	}
+	event := Event{
+		Timestamp: time.Now(),
+		Description: EventDescription{
+			Type: "legacyEvent",
+			Details: map[string]interface{}{
+				"raw":    string(details),
+				"record": rec, // Encoded as base64.
+			},
+		},
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// Keys come from the id-data sequence so it can be replayed.
+	key, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err := quarantine.Put(uint64ToBytes(key), data); err != nil {
+		return err
+	}
+	if err := adjustQuarantinedSize(tx, 1, int64(8+len(data))); err != nil {
+		return err
+	}
+	attemptsData, err := json.Marshal(Attempts{
+		LastError:   fmt.Sprintf("reading legacy event: %v", readErr),
+		LastAttempt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return legacy.Put(uint64ToBytes(key), attemptsData)
+}
+
+// legacyEvents converts the details and timestamps of an old style event
+// into events. The old details were the JSON description sent to the
+// API, for example {"description":{"type":"foo","details":{}}}. Details
+// that can't be read that way are kept as a string so nothing is lost.
+func legacyEvents(details []byte, timestamps []time.Time) []Event {
+	var decoded Event
+	if err := json.Unmarshal(details, &decoded); err != nil || decoded.Description.Type == "" {
+		decoded.Description = EventDescription{
+			Type:    "legacyEvent",
+			Details: map[string]interface{}{"raw": string(details)},
+		}
+	}
+
+	events := make([]Event, 0, len(timestamps))
+	for _, t := range timestamps {
+		events = append(events, Event{
+			Timestamp:   t,
+			Description: decoded.Description,
+		})
+	}
+	return events
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -0,0 +1,102 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import "github.com/boltdb/bolt"
+
+// Reasons events are dropped, given to Notifier.EventsDropped.
+const (
+	DroppedRateLimit = "rateLimit" // The event type was being rate limited.
+	DroppedLimits    = "limits"    // The store was over its size limits.
+)
+
+// Types of the events the store makes itself.
+const (
+	RateLimitType        = "rateLimit"        // Events of a type started being rate limited.
+	RateLimitSummaryType = "rateLimitSummary" // Events of a type stopped being rate limited.
+	EventsDroppedType    = "eventsDropped"    // Events were dropped to keep within the limits.
+)
+
+// Notifier is told about changes to the event store after they have been
+// committed. It is called with no locks held but shouldn't block.
+type Notifier interface {
+	EventAdded(key uint64, event *Event)
+	EventsDropped(reason string, count int)
+}
+
+// changes records what a transaction did so the notifier can be told
+// once it has been committed.
+type changes struct {
+	added             []KeyedEvent
+	dropped           map[string]int
+	rateLimits        map[string]rateLimit // Token buckets changed by the transaction.
+	expiredRateLimits []string             // Token buckets deleted by the transaction.
+}
+
+func (c *changes) setRateLimit(key string, rl rateLimit) {
+	if c.rateLimits == nil {
+		c.rateLimits = map[string]rateLimit{}
+	}
+	c.rateLimits[key] = rl
+}
+
+func (c *changes) drop(reason string, count int) {
+	if count == 0 {
+		return
+	}
+	if c.dropped == nil {
+		c.dropped = map[string]int{}
+	}
+	c.dropped[reason] += count
+}
+
+// removeDeleted forgets added events that have since been deleted in the
+// transaction, such as when evicted to keep the store within its limits.
+func (c *changes) removeDeleted(tx *bolt.Tx) {
+	bucket := tx.Bucket(idDataBucketName)
+	added := c.added[:0]
+	for _, e := range c.added {
+		if bucket.Get(uint64ToBytes(e.Key)) != nil {
+			added = append(added, e)
+		}
+	}
+	c.added = added
+}
+
+// SetNotifier sets what is told about added and dropped events.
+func (s *EventStore) SetNotifier(n Notifier) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.notifier = n
+}
+
+func (s *EventStore) notify(c *changes) {
+	s.mux.Lock()
+	n := s.notifier
+	s.mux.Unlock()
+	if n == nil {
+		return
+	}
+	for i := range c.added {
+		n.EventAdded(c.added[i].Key, &c.added[i].Event)
+	}
+	for reason, count := range c.dropped {
+		n.EventsDropped(reason, count)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Each destination has a bucket inside the attempts bucket holding its
+// failed attempts at delivering events, so one failing destination doesn't
+// affect the others. A destination that gives up on an event quarantines
+// it, which is marked in its delivered bucket. Once every destination has
+// delivered or quarantined an event, it is moved into the quarantine
+// bucket if any of them quarantined it.
+
+// legacyAttempts holds the attempts recorded before they were kept per
+// destination, and those of legacy events that couldn't be migrated.
+const legacyAttempts = "legacy"
+
+// quarantinedMark is put in a destination's delivered bucket for the
+// events it has quarantined.
+var quarantinedMark = []byte{1}
+
+// Attempts records the failed attempts at uploading an event.
+type Attempts struct {
+	Count             int       `json:"count"`
+	PermanentFailures int       `json:"permanentFailures"`
+	LastError         string    `json:"lastError"`
+	LastAttempt       time.Time `json:"lastAttempt"`
+}
+
+// QuarantinedEvent is an event that was moved out of the upload queue
+// because it kept failing, along with the failed attempts of each
+// destination.
+type QuarantinedEvent struct {
+	Event    Event               `json:"event"`
+	Attempts map[string]Attempts `json:"attempts"`
+}
+
+func getAttempts(bucket *bolt.Bucket, key []byte) (Attempts, error) {
+	var attempts Attempts
+	if bucket == nil {
+		return attempts, nil
+	}
+	val := bucket.Get(key)
+	if val == nil {
+		return attempts, nil
+	}
+	err := json.Unmarshal(val, &attempts)
+	return attempts, err
+}
+
+// RecordFailure records a failed attempt at uploading each of the events
+// to the destination. permanent should be true if retrying the upload is
+// not expected to help. The updated attempts are returned for each event.
+func (s *EventStore) RecordFailure(destination string, keys []uint64, uploadErr error, permanent bool) (map[uint64]Attempts, error) {
+	out := map[uint64]Attempts{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		attemptsBucket := tx.Bucket(attemptsBucketName)
+		if attemptsBucket == nil {
+			return noBucketErr(attemptsBucketName)
+		}
+		bucket, err := attemptsBucket.CreateBucketIfNotExists([]byte(destination))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			attempts, err := getAttempts(bucket, uint64ToBytes(key))
+			if err != nil {
+				return err
+			}
+			attempts.Count++
+			if permanent {
+				attempts.PermanentFailures++
+			}
+			attempts.LastError = uploadErr.Error()
+			attempts.LastAttempt = time.Now()
+			data, err := json.Marshal(attempts)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(uint64ToBytes(key), data); err != nil {
+				return err
+			}
+			out[key] = attempts
+		}
+		return nil
+	})
+	return out, err
+}
+
+// GetAttempts returns the failed attempts at uploading an event to the
+// destination.
+func (s *EventStore) GetAttempts(destination string, key uint64) (Attempts, error) {
+	var attempts Attempts
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(attemptsBucketName)
+		if bucket == nil {
+			return noBucketErr(attemptsBucketName)
+		}
+		var err error
+		attempts, err = getAttempts(bucket.Bucket([]byte(destination)), uint64ToBytes(key))
+		return err
+	})
+	return attempts, err
+}
+
+// clearAttempts removes the failed attempts of an event for every
+// destination.
+func clearAttempts(tx *bolt.Tx, key []byte) error {
+	attempts := tx.Bucket(attemptsBucketName)
+	if attempts == nil {
+		return noBucketErr(attemptsBucketName)
+	}
+	var dests [][]byte
+	attempts.ForEach(func(k, v []byte) error {
+		dests = append(dests, k)
+		return nil
+	})
+	for _, name := range dests {
+		if err := attempts.Bucket(name).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine stops the events being uploaded to the destination. Once
+// every destination has delivered or quarantined an event it is moved
+// into the quarantine bucket, keeping its key and attempts so it can be
+// inspected and replayed later. Quarantined events are not indexed.
+func (s *EventStore) Quarantine(destination string, keys []uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		dest, err := destinationBucket(tx, destination)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(idDataBucketName)
+		if bucket == nil {
+			return noBucketErr(idDataBucketName)
+		}
+		var quarantined [][]byte
+		for _, key := range keys {
+			k := uint64ToBytes(key)
+			if bucket.Get(k) == nil {
+				continue // Already removed.
+			}
+			if err := dest.Put(k, quarantinedMark); err != nil {
+				return err
+			}
+			quarantined = append(quarantined, k)
+		}
+		return removeIfSettled(tx, quarantined)
+	})
+}
+
+// Replay moves an event from quarantine back into the upload queue for
+// the destinations that quarantined it, clearing its failed attempts. It
+// is given a new key, which is returned, so collectors that have already
+// acknowledged past its old key get it.
+func (s *EventStore) Replay(key uint64) (uint64, error) {
+	var newKey uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(quarantineBucketName)
+		if bucket == nil {
+			return noBucketErr(quarantineBucketName)
+		}
+		k := uint64ToBytes(key)
+		val := bucket.Get(k)
+		if val == nil {
+			return fmt.Errorf("no quarantined key %v found", key)
+		}
+		event := &Event{}
+		if err := json.Unmarshal(val, event); err != nil {
+			return err
+		}
+		var err error
+		if newKey, err = putEvent(tx, event); err != nil {
+			return err
+		}
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+		if err := adjustQuarantinedSize(tx, -1, -int64(len(k)+len(val))); err != nil {
+			return err
+		}
+		if err := clearAttempts(tx, k); err != nil {
+			return err
+		}
+		if err := moveDelivered(tx, k, uint64ToBytes(newKey)); err != nil {
+			return err
+		}
+		return removeIfSettled(tx, [][]byte{uint64ToBytes(newKey)})
+	})
+	return newKey, err
+}
+
+func moveEvents(tx *bolt.Tx, from, to []byte, keys []uint64) error {
+	fromBucket := tx.Bucket(from)
+	if fromBucket == nil {
+		return noBucketErr(from)
+	}
+	toBucket := tx.Bucket(to)
+	if toBucket == nil {
+		return noBucketErr(to)
+	}
+	for _, key := range keys {
+		k := uint64ToBytes(key)
+		val := fromBucket.Get(k)
+		if val == nil {
+			return fmt.Errorf("no key %v found", key)
+		}
+		size := int64(len(k) + len(val))
+		if bytes.Equal(from, idDataBucketName) {
+			if err := unindexStored(tx, k, val); err != nil {
+				return err
+			}
+			if err := adjustStoredSize(tx, -1, -size); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(from, quarantineBucketName) {
+			if err := adjustQuarantinedSize(tx, -1, -size); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(to, quarantineBucketName) {
+			if err := adjustQuarantinedSize(tx, 1, size); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(to, idDataBucketName) {
+			event := &Event{}
+			if err := json.Unmarshal(val, event); err != nil {
+				return err
+			}
+			if err := indexEvent(tx, key, event); err != nil {
+				return err
+			}
+			if err := adjustStoredSize(tx, 1, size); err != nil {
+				return err
+			}
+		}
+		if err := toBucket.Put(k, append([]byte{}, val...)); err != nil {
+			return err
+		}
+		if err := fromBucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetQuarantinedKeys returns the keys of all quarantined events.
+func (s *EventStore) GetQuarantinedKeys() ([]uint64, error) {
+	keys := []uint64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(quarantineBucketName)
+		if bucket == nil {
+			return noBucketErr(quarantineBucketName)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, bytesToUint64(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// GetQuarantined returns a quarantined event and its failed attempts.
+func (s *EventStore) GetQuarantined(key uint64) (*QuarantinedEvent, error) {
+	q := &QuarantinedEvent{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(quarantineBucketName)
+		if bucket == nil {
+			return noBucketErr(quarantineBucketName)
+		}
+		val := bucket.Get(uint64ToBytes(key))
+		if val == nil {
+			return fmt.Errorf("no quarantined key %v found", key)
+		}
+		if err := json.Unmarshal(val, &q.Event); err != nil {
+			return err
+		}
+		attempts := tx.Bucket(attemptsBucketName)
+		if attempts == nil {
+			return noBucketErr(attemptsBucketName)
+		}
+		q.Attempts = map[string]Attempts{}
+		return attempts.ForEach(func(k, v []byte) error {
+			dest := attempts.Bucket(k)
+			if dest == nil || dest.Get(uint64ToBytes(key)) == nil {
+				return nil
+			}
+			a, err := getAttempts(dest, uint64ToBytes(key))
+			if err != nil {
+				return err
+			}
+			q.Attempts[string(k)] = a
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// DeleteQuarantined permanently removes a quarantined event.
+func (s *EventStore) DeleteQuarantined(key uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteQuarantined(tx, uint64ToBytes(key))
+	})
+}
+
+func deleteQuarantined(tx *bolt.Tx, key []byte) error {
+	bucket := tx.Bucket(quarantineBucketName)
+	if bucket == nil {
+		return noBucketErr(quarantineBucketName)
+	}
+	if val := bucket.Get(key); val != nil {
+		if err := adjustQuarantinedSize(tx, -1, -int64(len(key)+len(val))); err != nil {
+			return err
+		}
+	}
+	if err := bucket.Delete(key); err != nil {
+		return err
+	}
+	if err := clearAttempts(tx, key); err != nil {
+		return err
+	}
+	return clearDelivered(tx, key)
+}
@@ -0,0 +1,132 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Filter selects events for Query. Fields left empty don't filter.
+type Filter struct {
+	Types    []string               `json:"types"`    // Any of these event types.
+	From     time.Time              `json:"from"`     // Events at or after this time.
+	To       time.Time              `json:"to"`       // Events before this time.
+	Severity string                 `json:"severity"` // Events without a severity are "info".
+	Details  map[string]interface{} `json:"details"`  // Details that must match.
+	Limit    int                    `json:"limit"`
+	Offset   int                    `json:"offset"`
+}
+
+// Query returns the events that match the filter, oldest first. The
+// index buckets are used to find events of the types and time range so
+// only those events are read.
+func (s *EventStore) Query(filter Filter) ([]KeyedEvent, error) {
+	events := []KeyedEvent{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		typeIndex, timeIndex, err := indexBuckets(tx)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(idDataBucketName)
+		if bucket == nil {
+			return noBucketErr(idDataBucketName)
+		}
+
+		var entries [][]byte
+		if len(filter.Types) > 0 {
+			for _, t := range filter.Types {
+				entries = append(entries, scanIndex(typeIndex, typePrefix(t), filter.From, filter.To)...)
+			}
+			if len(filter.Types) > 1 {
+				slices.SortFunc(entries, bytes.Compare)
+				entries = slices.CompactFunc(entries, bytes.Equal)
+			}
+		} else {
+			entries = scanIndex(timeIndex, nil, filter.From, filter.To)
+		}
+
+		skipped := 0
+		for _, entry := range entries {
+			if filter.Limit > 0 && len(events) >= filter.Limit {
+				break
+			}
+			key := keyFromIndex(entry)
+			val := bucket.Get(uint64ToBytes(key))
+			if val == nil {
+				continue
+			}
+			e := KeyedEvent{Key: key}
+			if err := json.Unmarshal(val, &e.Event); err != nil {
+				return err
+			}
+			if !filter.matches(&e.Event) {
+				continue
+			}
+			if skipped < filter.Offset {
+				skipped++
+				continue
+			}
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// matches checks the parts of the filter that aren't indexed.
+func (f *Filter) matches(event *Event) bool {
+	if f.Severity != "" {
+		severity, _ := event.Description.Details[severityKey].(string)
+		if severity == "" {
+			severity = severityInfo
+		}
+		if severity != f.Severity {
+			return false
+		}
+	}
+	for k, want := range f.Details {
+		got, ok := event.Description.Details[k]
+		if !ok || !jsonEqual(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonEqual compares values by their JSON encoding, so that a filter
+// value of 1 matches a detail decoded as 1.0.
+func jsonEqual(a, b interface{}) bool {
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aj, bj)
+}
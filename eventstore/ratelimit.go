@@ -0,0 +1,404 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// RateLimit is how often events of a type can be made before they are
+// rate limited. Burst events can be made at once, then one per Window.
+// Exempt types are never rate limited. If KeyFields are set, events with
+// different values of those details are limited separately, so one noisy
+// source doesn't suppress the events of others.
+type RateLimit struct {
+	Window    time.Duration `mapstructure:"window"`
+	Burst     int           `mapstructure:"burst"`
+	Exempt    bool          `mapstructure:"exempt"`
+	KeyFields []string      `mapstructure:"key-fields"`
+}
+
+// RateLimits has the rate limit for each event type. Types without their
+// own limit use Default. Type names are matched ignoring case as config
+// keys are not case sensitive.
+type RateLimits struct {
+	Default RateLimit            `mapstructure:"default"`
+	Types   map[string]RateLimit `mapstructure:"types"`
+}
+
+// DefaultRateLimits returns the rate limits used unless others are set.
+// Events made when offloading recordings are exempt as a lot of them are
+// expected in a short amount of time.
+func DefaultRateLimits() RateLimits {
+	limits := RateLimits{
+		Default: RateLimit{Window: 3 * time.Minute, Burst: 5},
+		Types:   map[string]RateLimit{},
+	}
+	for eventType := range whitelist {
+		limits.Types[eventType] = RateLimit{Exempt: true}
+	}
+	return limits
+}
+
+// Merge returns the limits with the given limits set over them. Unset
+// windows and bursts of the given limits are filled in from the default
+// and unset key fields from the type's limit being replaced.
+func (l RateLimits) Merge(over RateLimits) RateLimits {
+	out := RateLimits{Default: l.Default, Types: map[string]RateLimit{}}
+	if over.Default.Window > 0 {
+		out.Default.Window = over.Default.Window
+	}
+	if over.Default.Burst > 0 {
+		out.Default.Burst = over.Default.Burst
+	}
+	out.Default.Exempt = l.Default.Exempt || over.Default.Exempt
+	for eventType, limit := range l.Types {
+		out.Types[strings.ToLower(eventType)] = limit
+	}
+	for eventType, limit := range over.Types {
+		eventType = strings.ToLower(eventType)
+		if limit.KeyFields == nil {
+			limit.KeyFields = out.Types[eventType].KeyFields
+		}
+		out.Types[eventType] = limit
+	}
+	for eventType, limit := range out.Types {
+		if limit.Window <= 0 {
+			limit.Window = out.Default.Window
+		}
+		if limit.Burst <= 0 {
+			limit.Burst = out.Default.Burst
+		}
+		out.Types[eventType] = limit
+	}
+	return out
+}
+
+func (l RateLimits) forType(eventType string) RateLimit {
+	if limit, ok := l.Types[strings.ToLower(eventType)]; ok {
+		return limit
+	}
+	return l.Default
+}
+
+// rateLimitKey returns the key of the token bucket for the event, the
+// type followed by the values of the key fields, and those values.
+func rateLimitKey(event *Event, limit RateLimit) (string, map[string]interface{}) {
+	if len(limit.KeyFields) == 0 {
+		return event.Description.Type, nil
+	}
+	key := event.Description.Type
+	fields := map[string]interface{}{}
+	for _, field := range limit.KeyFields {
+		value := event.Description.Details[field]
+		fields[field] = value
+		key += fmt.Sprintf(" %s=%v", field, value)
+	}
+	return key, fields
+}
+
+// SetRateLimits sets the rate limit for each event type.
+func (s *EventStore) SetRateLimits(limits RateLimits) {
+	limits = DefaultRateLimits().Merge(limits)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.rateLimitConfig = limits
+}
+
+// GetRateLimits returns the rate limits in use.
+func (s *EventStore) GetRateLimits() RateLimits {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.rateLimitConfig
+}
+
+// Each event type, or each set of values of its key fields, has a token
+// bucket that holds up to Burst tokens and refills at one token per
+// Window. An event uses a token and is
+// suppressed if there isn't one. Tokens are tracked as time, each one
+// being worth Window, so refilling is exact.
+//
+// A rateLimit event is made when suppression of a type starts. It ends
+// when the bucket has refilled, then a rateLimitSummary event is made
+// with how many events were suppressed, when, and some of their details.
+//
+// The buckets are saved in the rate-limits bucket in the same transaction
+// as the events so a restart doesn't refill them.
+type rateLimit struct {
+	Type       string                   `json:"type"`
+	Fields     map[string]interface{}   `json:"fields,omitempty"` // Values of the key fields.
+	Time       time.Time                `json:"time"`             // Time of the last event.
+	Credit     time.Duration            `json:"credit"`           // Tokens left, as time.
+	Capacity   time.Duration            `json:"capacity"`         // Credit when full.
+	Suppressed int                      `json:"suppressed"`
+	From       time.Time                `json:"from"` // Time of the first suppressed event.
+	To         time.Time                `json:"to"`   // Time of the last suppressed event.
+	Samples    []map[string]interface{} `json:"samples"`
+}
+
+// Number of suppressed events to keep the details of for the summary.
+const rateLimitSamples = 3
+
+// refill adds the tokens for the time since the last event. The gap is
+// used either way as the RP2040 offloads events newest to oldest or
+// oldest to newest.
+func (rl *rateLimit) refill(t time.Time) {
+	elapsed := t.Sub(rl.Time)
+	if elapsed < 0 {
+		elapsed = -elapsed
+	}
+	rl.Credit = min(rl.Credit+elapsed, rl.Capacity)
+}
+
+func (rl *rateLimit) suppress(event *Event) {
+	t := event.Timestamp
+	if rl.Suppressed == 0 || t.Before(rl.From) {
+		rl.From = t
+	}
+	if rl.Suppressed == 0 || t.After(rl.To) {
+		rl.To = t
+	}
+	rl.Suppressed++
+	if len(rl.Samples) < rateLimitSamples {
+		rl.Samples = append(rl.Samples, event.Description.Details)
+	}
+}
+
+// expired returns true if the bucket has refilled by now and has no
+// suppressed events to summarise, so it is the same as a new bucket.
+func (rl rateLimit) expired(now time.Time) bool {
+	if rl.Suppressed > 0 {
+		return false
+	}
+	rl.refill(now)
+	return rl.Credit >= rl.Capacity
+}
+
+// endSuppression clears the suppressed events once they are summarised.
+func (rl *rateLimit) endSuppression() {
+	*rl = rateLimit{Type: rl.Type, Fields: rl.Fields, Time: rl.Time, Credit: rl.Credit, Capacity: rl.Capacity}
+}
+
+// shouldBeRateLimited checks if that type of event is being made too often
+// and updates its token bucket in c. Any rateLimit or rateLimitSummary
+// events are returned to be added along with the other events.
+func (s *EventStore) shouldBeRateLimited(c *changes, event *Event) (bool, []*Event) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	eventType := event.Description.Type
+	limit := s.rateLimitConfig.forType(eventType)
+	if limit.Exempt {
+		return false, nil
+	}
+
+	capacity := time.Duration(limit.Burst) * limit.Window
+	key, fields := rateLimitKey(event, limit)
+	rl, ok := c.rateLimits[key]
+	if !ok {
+		rl, ok = s.rateLimits[key]
+	}
+	if ok {
+		rl.Capacity = capacity
+		rl.refill(event.Timestamp)
+	} else {
+		rl = rateLimit{Type: eventType, Fields: fields, Credit: capacity, Capacity: capacity}
+	}
+	rl.Time = event.Timestamp
+
+	var out []*Event
+	if rl.Suppressed > 0 && rl.Credit >= rl.Capacity {
+		out = append(out, rateLimitSummary(&rl))
+		rl.endSuppression()
+	}
+
+	limited := rl.Credit < limit.Window
+	if limited {
+		if rl.Suppressed == 0 {
+			out = append(out, newRateLimitEvent(RateLimitType, &rl, map[string]interface{}{
+				severityKey: severityError,
+			}))
+		}
+		rl.suppress(event)
+	} else {
+		rl.Credit -= limit.Window
+	}
+	c.setRateLimit(key, rl)
+	return limited, out
+}
+
+// saveRateLimits writes the buckets changed in the transaction and
+// deletes the expired ones.
+func saveRateLimits(tx *bolt.Tx, c *changes) error {
+	if len(c.rateLimits) == 0 && len(c.expiredRateLimits) == 0 {
+		return nil
+	}
+	bucket := tx.Bucket(rateLimitsBucketName)
+	if bucket == nil {
+		return noBucketErr(rateLimitsBucketName)
+	}
+	for _, key := range c.expiredRateLimits {
+		if err := bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	for key, rl := range c.rateLimits {
+		data, err := json.Marshal(rl)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(key), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRateLimits updates the buckets in memory once the transaction that
+// changed them has been committed.
+func (s *EventStore) applyRateLimits(c *changes) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, key := range c.expiredRateLimits {
+		delete(s.rateLimits, key)
+	}
+	for key, rl := range c.rateLimits {
+		s.rateLimits[key] = rl
+	}
+}
+
+// loadRateLimits reads the saved buckets. Buckets that have refilled
+// since, and have no suppressed events to summarise, are deleted as they
+// are the same as a new bucket.
+func loadRateLimits(tx *bolt.Tx, now time.Time) (map[string]rateLimit, error) {
+	bucket := tx.Bucket(rateLimitsBucketName)
+	if bucket == nil {
+		return nil, noBucketErr(rateLimitsBucketName)
+	}
+	rateLimits := map[string]rateLimit{}
+	var expired [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		var rl rateLimit
+		if err := json.Unmarshal(v, &rl); err != nil {
+			log.Errorf("failed to read rate limit for '%s': %v", k, err)
+			expired = append(expired, append([]byte{}, k...))
+			return nil
+		}
+		if rl.Type == "" {
+			rl.Type = string(k) // Saved before buckets could be per key field.
+		}
+		if rl.expired(now) {
+			expired = append(expired, append([]byte{}, k...))
+			return nil
+		}
+		rateLimits[string(k)] = rl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return rateLimits, nil
+}
+
+// FlushRateLimitSummaries adds the rateLimitSummary events for types that
+// have stopped being suppressed but haven't had an event since. Buckets
+// that have refilled are deleted so ones for key field values that are
+// no longer seen don't build up.
+func (s *EventStore) FlushRateLimitSummaries(now time.Time) error {
+	s.mux.Lock()
+	due := false
+	for _, rl := range s.rateLimits {
+		if summaryDue(rl, now) || rl.expired(now) {
+			due = true
+			break
+		}
+	}
+	s.mux.Unlock()
+	if !due {
+		return nil
+	}
+
+	return s.update(func(tx *bolt.Tx, c *changes) error {
+		var summaries []*Event
+		s.mux.Lock()
+		for key, rl := range s.rateLimits {
+			if summaryDue(rl, now) {
+				summaries = append(summaries, rateLimitSummary(&rl))
+				rl.endSuppression()
+			}
+			// Summarised buckets have refilled so are deleted too.
+			if rl.expired(now) {
+				c.expiredRateLimits = append(c.expiredRateLimits, key)
+			}
+		}
+		s.mux.Unlock()
+		_, err := s.putEvents(tx, summaries, c)
+		return err
+	})
+}
+
+// summaryDue returns true if the bucket has suppressed events and has
+// refilled by now.
+func summaryDue(rl rateLimit, now time.Time) bool {
+	if rl.Suppressed == 0 {
+		return false
+	}
+	rl.refill(now)
+	return rl.Credit >= rl.Capacity
+}
+
+func rateLimitSummary(rl *rateLimit) *Event {
+	return newRateLimitEvent(RateLimitSummaryType, rl, map[string]interface{}{
+		"suppressed": rl.Suppressed,
+		"from":       rl.From,
+		"to":         rl.To,
+		"samples":    rl.Samples,
+		severityKey:  severityWarning,
+	})
+}
+
+func newRateLimitEvent(eventType string, rl *rateLimit, details map[string]interface{}) *Event {
+	details["rate_limited_event"] = rl.Type
+	if rl.Fields != nil {
+		details["rate_limited_fields"] = rl.Fields
+	}
+	environment, err := getNodegroupFunc()
+	if err != nil {
+		log.Errorf("failed to read nodegroup file: %v", err)
+	} else {
+		details["env"] = environment
+	}
+	return &Event{
+		Timestamp: time.Now(),
+		Description: EventDescription{
+			Type:    eventType,
+			Details: details,
+		},
+	}
+}
@@ -0,0 +1,60 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// SaveState stores v as JSON under the given name so it can be loaded
+// with LoadState after a restart.
+func (s *EventStore) SaveState(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucketName)
+		if bucket == nil {
+			return noBucketErr(stateBucketName)
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
+
+// LoadState reads the state saved under the given name into v. It
+// returns false if no state has been saved under that name.
+func (s *EventStore) LoadState(name string, v interface{}) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucketName)
+		if bucket == nil {
+			return noBucketErr(stateBucketName)
+		}
+		data := bucket.Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found, err
+}
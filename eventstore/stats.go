@@ -0,0 +1,87 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventstore
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Stats describes the events waiting in the event store.
+type Stats struct {
+	Pending       map[string]int `json:"pending"`       // Number of events of each type.
+	OldestPending time.Time      `json:"oldestPending"` // Zero if there are no events.
+	RateLimited   map[string]int `json:"rateLimited"`   // Events of each type suppressed since the last rateLimitSummary.
+	DBSize        int64          `json:"dbSize"`        // Size of the database file in bytes.
+}
+
+// Stats returns the number of events of each type, the timestamp of the
+// oldest and how many are being rate limited. The counts come from the
+// index buckets so the events aren't read.
+func (s *EventStore) Stats() (Stats, error) {
+	stats := Stats{Pending: map[string]int{}, RateLimited: map[string]int{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		typeIndex, timeIndex, err := indexBuckets(tx)
+		if err != nil {
+			return err
+		}
+		err = typeIndex.ForEach(func(k, v []byte) error {
+			stats.Pending[typeFromIndex(k)]++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if k, _ := timeIndex.Cursor().First(); k != nil {
+			stats.OldestPending = timeFromKey(k)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return stats, err
+	}
+	stats.DBSize = info.Size()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, rl := range s.rateLimits {
+		if rl.Suppressed > 0 {
+			stats.RateLimited[rl.Type] += rl.Suppressed
+		}
+	}
+	return stats, nil
+}
+
+// typeFromIndex returns the event type at the start of a type-time index key.
+func typeFromIndex(k []byte) string {
+	return string(k[:len(k)-17])
+}
+
+// timeFromKey decodes the timestamp at the start of a time index key.
+func timeFromKey(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])^(1<<63)))
+}
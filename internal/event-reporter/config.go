@@ -0,0 +1,111 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+	config "github.com/TheCacophonyProject/go-config"
+	"github.com/fsnotify/fsnotify"
+)
+
+// rateLimitsKey is where the rate limits are in the device config, e.g.
+//
+//	[event-reporter.rate-limits.default]
+//	window = "3m"
+//	burst = 5
+//
+//	[event-reporter.rate-limits.types.systemError]
+//	window = "10m"
+//	burst = 2
+//
+//	[event-reporter.rate-limits.types.OffloadedRecording]
+//	exempt = true
+const rateLimitsKey = "event-reporter.rate-limits"
+
+// Config changes are often written as several file operations so wait
+// for them to finish before reloading.
+const configReloadDelay = time.Second
+
+func loadRateLimits(configDir string) (eventstore.RateLimits, error) {
+	var limits eventstore.RateLimits
+	conf, err := config.New(configDir)
+	if err != nil {
+		return limits, err
+	}
+	err = conf.Unmarshal(rateLimitsKey, &limits)
+	return limits, err
+}
+
+// applyRateLimits sets the rate limits of the store from the config. If
+// the config can't be read the defaults are used.
+func applyRateLimits(store *eventstore.EventStore, configDir string) {
+	limits, err := loadRateLimits(configDir)
+	if err != nil {
+		log.Errorf("failed to read rate limits from config, using defaults: %v", err)
+		limits = eventstore.RateLimits{}
+	}
+	store.SetRateLimits(limits)
+}
+
+// watchRateLimits applies the rate limits from the config now and again
+// each time the config file changes, until done is closed.
+func watchRateLimits(store *eventstore.EventStore, configDir string, done <-chan struct{}) error {
+	applyRateLimits(store, configDir)
+
+	// Watch the directory as the file may be replaced rather than written to.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(configDir); err != nil {
+		watcher.Close()
+		return err
+	}
+	configFile := filepath.Join(configDir, config.ConfigFileName)
+
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == configFile {
+					reload = time.After(configReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("error watching config: %v", err)
+			case <-reload:
+				log.Info("config changed, reloading rate limits")
+				applyRateLimits(store, configDir)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
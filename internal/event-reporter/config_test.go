@@ -0,0 +1,77 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+func (s *Suite) writeConfig(dir, contents string) {
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "config.toml"), []byte(contents), 0644))
+}
+
+func (s *Suite) TestRateLimitsFromConfig() {
+	configDir := filepath.Join(s.tempDir, "config")
+	s.Require().NoError(os.Mkdir(configDir, 0755))
+	s.writeConfig(configDir, `
+[event-reporter.rate-limits.default]
+burst = 10
+
+[event-reporter.rate-limits.types.systemError]
+window = "10m"
+burst = 2
+key-fields = ["unitName"]
+
+[event-reporter.rate-limits.types.OffloadedRecording]
+burst = 3
+
+[event-reporter.rate-limits.types.rpiBattery]
+key-fields = ["battery", "source"]
+`)
+
+	done := make(chan struct{})
+	defer close(done)
+	s.Require().NoError(watchRateLimits(s.store, configDir, done))
+	limits := s.store.GetRateLimits()
+	s.Equal(eventstore.RateLimit{Window: 3 * time.Minute, Burst: 10}, limits.Default)
+	s.Equal(eventstore.RateLimit{Window: 10 * time.Minute, Burst: 2, KeyFields: []string{"unitName"}}, limits.Types["systemerror"])
+	s.Equal(eventstore.RateLimit{Window: 3 * time.Minute, Burst: 3}, limits.Types["offloadedrecording"])
+	s.True(limits.Types["startedrecording"].Exempt)
+	s.Equal([]string{"battery", "source"}, limits.Types["rpibattery"].KeyFields)
+
+	// Changes to the config are picked up.
+	s.writeConfig(configDir, `
+[event-reporter.rate-limits.types.systemError]
+exempt = true
+`)
+	s.Eventually(func() bool {
+		return s.store.GetRateLimits().Types["systemerror"].Exempt
+	}, 5*time.Second, 100*time.Millisecond)
+	s.Equal(eventstore.DefaultRateLimits().Default, s.store.GetRateLimits().Default)
+
+	// The defaults are used if the config can't be read.
+	s.writeConfig(configDir, "not toml [")
+	s.Eventually(func() bool {
+		return !s.store.GetRateLimits().Types["systemerror"].Exempt
+	}, 5*time.Second, 100*time.Millisecond)
+}
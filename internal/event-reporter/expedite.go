@@ -0,0 +1,124 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+const expediteStateName = "expedited-uploads"
+
+// expediter requests an upload soon after an error event is added rather
+// than leaving it until the next scheduled upload. Error events within
+// the debounce window of the first are sent in the same upload. As each
+// expedited upload can bring the modem up, they are capped per day.
+type expediter struct {
+	store            *eventstore.EventStore
+	uploadEventsChan chan bool
+	types            map[string]struct{} // If empty all error events are expedited.
+	debounce         time.Duration
+	dailyCap         int
+
+	mu      sync.Mutex
+	pending bool
+	state   expediteState
+
+	// Replaced in tests.
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func())
+}
+
+type expediteState struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+func newExpediter(
+	store *eventstore.EventStore,
+	uploadEventsChan chan bool,
+	types []string,
+	debounce time.Duration,
+	dailyCap int,
+) *expediter {
+	e := &expediter{
+		store:            store,
+		uploadEventsChan: uploadEventsChan,
+		types:            map[string]struct{}{},
+		debounce:         debounce,
+		dailyCap:         dailyCap,
+		now:              time.Now,
+		afterFunc:        func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+	}
+	for _, t := range types {
+		e.types[t] = struct{}{}
+	}
+	if _, err := store.LoadState(expediteStateName, &e.state); err != nil {
+		log.Errorf("failed to load expedited upload state: %v", err)
+	}
+	return e
+}
+
+// errorEvent is called when an error event of the given type is added.
+func (e *expediter) errorEvent(eventType string) {
+	if e == nil || e.dailyCap <= 0 {
+		return
+	}
+	if len(e.types) > 0 {
+		if _, ok := e.types[eventType]; !ok {
+			return
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending {
+		return
+	}
+	today := e.now().Format(time.DateOnly)
+	if e.state.Day != today {
+		e.state = expediteState{Day: today}
+	}
+	if e.state.Count >= e.dailyCap {
+		log.Printf("already made %d expedited upload%s today, '%s' event will be sent with the next upload",
+			e.state.Count, plural(e.state.Count), eventType)
+		return
+	}
+	e.state.Count++
+	if err := e.store.SaveState(expediteStateName, e.state); err != nil {
+		log.Errorf("failed to save expedited upload state: %v", err)
+	}
+	e.pending = true
+	log.Printf("'%s' error event, uploading events in %s", eventType, e.debounce)
+	e.afterFunc(e.debounce, e.requestUpload)
+}
+
+func (e *expediter) requestUpload() {
+	e.mu.Lock()
+	e.pending = false
+	e.mu.Unlock()
+	select {
+	case e.uploadEventsChan <- true:
+		log.Println("expedited upload requested")
+	case <-time.After(2 * time.Second):
+		log.Println("Already uploading")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+// fakeTimers holds the functions given to afterFunc until they are fired.
+type fakeTimers struct {
+	funcs []func()
+}
+
+func (t *fakeTimers) afterFunc(d time.Duration, f func()) {
+	t.funcs = append(t.funcs, f)
+}
+
+// fire runs the functions waiting for their timer and returns how many
+// there were.
+func (t *fakeTimers) fire() int {
+	funcs := t.funcs
+	t.funcs = nil
+	for _, f := range funcs {
+		f()
+	}
+	return len(funcs)
+}
+
+func (s *Suite) newTestExpediter(uploadEventsChan chan bool, types []string, now *time.Time) (*expediter, *fakeTimers) {
+	timers := &fakeTimers{}
+	exp := newExpediter(s.store, uploadEventsChan, types, time.Minute, 2)
+	exp.now = func() time.Time { return *now }
+	exp.afterFunc = timers.afterFunc
+	return exp, timers
+}
+
+func (s *Suite) TestExpediteErrorEvents() {
+	uploadEventsChan := make(chan bool, 10)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	exp, timers := s.newTestExpediter(uploadEventsChan, []string{"systemError"}, &now)
+
+	// Only configured types are expedited.
+	exp.errorEvent("otherError")
+	s.Equal(0, timers.fire())
+	s.Equal(0, len(uploadEventsChan))
+
+	// A burst of errors results in one upload once the debounce is over.
+	for range 5 {
+		exp.errorEvent("systemError")
+	}
+	s.Equal(0, len(uploadEventsChan))
+	s.Equal(1, timers.fire())
+	s.Equal(1, len(uploadEventsChan))
+	<-uploadEventsChan
+
+	exp.errorEvent("systemError")
+	s.Equal(1, timers.fire())
+	s.Equal(1, len(uploadEventsChan))
+	<-uploadEventsChan
+
+	// The daily cap has been reached, including after a restart.
+	exp, timers = s.newTestExpediter(uploadEventsChan, nil, &now)
+	exp.errorEvent("systemError")
+	s.Equal(0, timers.fire())
+	s.Equal(0, len(uploadEventsChan))
+
+	// The cap resets the next day.
+	now = now.Add(24 * time.Hour)
+	exp.errorEvent("systemError")
+	s.Equal(1, timers.fire())
+	s.Equal(1, len(uploadEventsChan))
+}
+
+func (s *Suite) TestExpediteOnlyStoredEvents() {
+	uploadEventsChan := make(chan bool, 10)
+	schemas, err := newSchemaRegistry("", schemaOff)
+	s.Require().NoError(err)
+	now := time.Now()
+	exp, timers := s.newTestExpediter(uploadEventsChan, nil, &now)
+	exp.dailyCap = 10
+	svc := &service{
+		store:     s.store,
+		schemas:   schemas,
+		expediter: exp,
+	}
+	s.store.SetNotifier(svc)
+	s.store.SetRateLimits(eventstore.RateLimits{
+		Types: map[string]eventstore.RateLimit{"testError": {Window: time.Hour, Burst: 1}},
+	})
+	uploads := func() int {
+		timers.fire()
+		n := len(uploadEventsChan)
+		for range n {
+			<-uploadEventsChan
+		}
+		return n
+	}
+	details := `{"severity": "error"}`
+	unixNsec := now.UnixNano()
+
+	_, derr := svc.AddIdempotent(details, "testError", unixNsec, "a")
+	s.Nil(derr)
+	s.Equal(1, uploads())
+
+	// Repeats aren't stored again so don't expedite.
+	_, derr = svc.AddIdempotent(details, "testError", unixNsec, "a")
+	s.Nil(derr)
+	s.Equal(0, uploads())
+
+	// Nor do rate limited events.
+	id, derr := svc.AddWithID(details, "testError", unixNsec)
+	s.Nil(derr)
+	s.Equal(uint64(0), id)
+	s.Equal(0, uploads())
+}
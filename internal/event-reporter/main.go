@@ -30,12 +30,11 @@ import (
 
 	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+	config "github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
 	"github.com/TheCacophonyProject/modemd/connrequester"
 	"github.com/TheCacophonyProject/modemd/modemlistener"
 	arg "github.com/alexflint/go-arg"
-
-	"github.com/TheCacophonyProject/go-api"
 )
 
 const (
@@ -48,7 +47,7 @@ const (
 )
 
 var version = "No version provided"
-var log *logging.Logger
+var log = logging.NewLogger("info")
 var mu sync.Mutex
 var severityErrorTime = time.Time{}
 
@@ -97,8 +96,30 @@ func clearSeverityErrorTime() {
 }
 
 type Args struct {
-	DBPath   string        `arg:"-d,--db" help:"path to state database"`
-	Interval time.Duration `arg:"--interval" help:"time between event reports"`
+	DBPath          string        `arg:"-d,--db" help:"path to state database"`
+	ConfigDir       string        `arg:"--config-dir" help:"directory of the device config, rate limits are read from it"`
+	SchemaDir       string        `arg:"--schema-dir" help:"directory of JSON Schemas for event details, named <event type>.json"`
+	SchemaMode      string        `arg:"--schema-mode" help:"strict to reject events that don't match their schema, lenient to add the errors to the event, or off"`
+	SpoolDir        string        `arg:"--spool-dir" help:"directory eventclient spools events to when event-reporter isn't running"`
+	Interval        time.Duration `arg:"--interval" help:"time between event reports"`
+	MaxEvents       int           `arg:"--max-events" help:"maximum number of events to store, including quarantined ones, 0 for no limit"`
+	MaxEventBytes   int64         `arg:"--max-event-bytes" help:"maximum total size in bytes of the stored and quarantined events, not the database file, 0 for no limit"`
+	QuarantineAfter int           `arg:"--quarantine-after" help:"permanent upload failures before an event is quarantined"`
+	MaxBackoff      time.Duration `arg:"--max-backoff" help:"longest time to wait between uploads after failures"`
+	ExpediteTypes   []string      `arg:"--expedite-types" help:"error event types that trigger an immediate upload, all types if not set"`
+	ExpediteWait    time.Duration `arg:"--expedite-wait" help:"time to wait for more events before an expedited upload"`
+	ExpediteMax     int           `arg:"--expedite-max" help:"maximum expedited uploads per day, 0 to disable"`
+	NoAPI           bool          `arg:"--no-api" help:"don't upload events to the Cacophony API"`
+	WebhookURL      string        `arg:"--webhook-url" help:"URL to also POST events to"`
+	WebhookToken    string        `arg:"--webhook-token" help:"bearer token to send with webhook requests"`
+	WebhookHeaders  []string      `arg:"--webhook-header,separate" help:"extra header to send with webhook requests, as 'Name: value'"`
+	WebhookCAFile   string        `arg:"--webhook-ca-file" help:"file with CA certificates to trust for the webhook"`
+	WebhookLocal    bool          `arg:"--webhook-local" help:"the webhook is on the local network so doesn't need an internet connection"`
+	MQTTBroker      string        `arg:"--mqtt-broker" help:"MQTT broker to also publish events to, e.g. tcp://localhost:1883"`
+	MQTTTopic       string        `arg:"--mqtt-topic" help:"topic to publish events to, {device} and {type} are replaced"`
+	MQTTUsername    string        `arg:"--mqtt-username" help:"username for the MQTT broker"`
+	MQTTPassword    string        `arg:"--mqtt-password" help:"password for the MQTT broker"`
+	MQTTLocal       bool          `arg:"--mqtt-local" help:"the MQTT broker is on the local network so doesn't need an internet connection"`
 	logging.LogArgs
 }
 
@@ -107,8 +128,19 @@ func (Args) Version() string {
 }
 
 var defaultArgs = Args{
-	DBPath:   "/var/lib/event-reporter.db",
-	Interval: 30 * time.Minute,
+	DBPath:          "/var/lib/event-reporter.db",
+	ConfigDir:       config.DefaultConfigDir,
+	SchemaDir:       "/etc/cacophony/event-schemas",
+	SchemaMode:      schemaLenient,
+	SpoolDir:        eventclient.DefaultSpoolDir,
+	Interval:        30 * time.Minute,
+	MaxEvents:       10000,
+	MaxEventBytes:   20 * 1024 * 1024,
+	QuarantineAfter: 3,
+	MaxBackoff:      12 * time.Hour,
+	MQTTTopic:       "cacophony/{device}/events/{type}",
+	ExpediteWait:    time.Minute,
+	ExpediteMax:     5,
 }
 
 func procArgs(input []string) (Args, error) {
@@ -147,15 +179,31 @@ func Run(inputArgs []string, ver string) error {
 		return err
 	}
 	defer store.Close()
+	store.SetLimits(eventstore.Limits{
+		MaxEvents: args.MaxEvents,
+		MaxBytes:  args.MaxEventBytes,
+	})
+	configDone := make(chan struct{})
+	defer close(configDone)
+	if err := watchRateLimits(store, args.ConfigDir, configDone); err != nil {
+		log.Errorf("failed to watch config for rate limit changes: %v", err)
+	}
 
 	cr := connrequester.NewConnectionRequester()
 
 	uploadEventsChan := make(chan bool, 2)
 
-	err = StartService(store, uploadEventsChan)
+	exp := newExpediter(store, uploadEventsChan, args.ExpediteTypes, args.ExpediteWait, args.ExpediteMax)
+	schemas, err := newSchemaRegistry(args.SchemaDir, args.SchemaMode)
+	if err != nil {
+		return err
+	}
+	status := newUploadStatus(store)
+	svc, err := StartService(store, uploadEventsChan, exp, schemas, status)
 	if err != nil {
 		return err
 	}
+	svc.watchSpool(args.SpoolDir)
 
 	//If powered off time was saved make a powered off event
 	makePowerOffEvent()
@@ -164,31 +212,135 @@ func Run(inputArgs []string, ver string) error {
 		log.Println("Failed to get modem connected signal listener")
 	}
 
+	uploaders, err := makeUploaders(args)
+	if err != nil {
+		return err
+	}
+	if err := registerUploaders(store, uploaders); err != nil {
+		return err
+	}
+	scheduler := newUploadScheduler(store, args.Interval, args.MaxBackoff)
+	requested := false
 	for {
-		eventKeys, err := store.GetKeys()
-		if err != nil {
-			return err
-		}
-
-		sendCount := len(eventKeys)
-		if sendCount > 0 {
-			log.Printf("%d event%s to send", sendCount, plural(sendCount))
-			sendEvents(store, eventKeys, cr)
+		// Upload requests and the modem connecting skip any backoff.
+		if requested || scheduler.due() {
+			// Summaries of types no longer being rate limited are sent with
+			// the other events rather than waiting for the next event of the type.
+			if err := store.FlushRateLimitSummaries(time.Now()); err != nil {
+				log.Errorf("failed to add rate limit summaries: %v", err)
+			}
+			if err := store.PruneIdempotencyKeys(time.Now()); err != nil {
+				log.Errorf("failed to prune idempotency keys: %v", err)
+			}
+			sendCount, err := pendingCount(store, uploaders)
+			if err != nil {
+				return err
+			}
 
-			// Check if the devices logs should be uploaded also through salt.
-			uploadDevicesLogs()
+			if sendCount > 0 {
+				log.Printf("%d event%s to send", sendCount, plural(sendCount))
+				svc.uploadStarted()
+				status.started(time.Now())
+				result, err := sendEvents(store, cr, uploaders, args.QuarantineAfter)
+				status.completed(time.Now(), result, err)
+				svc.uploadCompleted(result, err)
+				scheduler.done(err)
+
+				// Check if the devices logs should be uploaded also through salt.
+				uploadDevicesLogs()
+			} else {
+				scheduler.done(nil)
+			}
 		}
 
 		// Empty modemConnectSignal channel so as to not trigger from old signals
 		emptyChannel(modemConnectSignal)
+		requested = true
 		select {
 		case <-uploadEventsChan:
 			log.Println("events upload requested")
 		case <-modemConnectSignal:
 			log.Println("Modem connected.")
-		case <-time.After(args.Interval):
+		case <-time.After(scheduler.untilNext()):
+			requested = false
+		}
+	}
+}
+
+func makeUploaders(args Args) ([]Uploader, error) {
+	var uploaders []Uploader
+	if !args.NoAPI {
+		uploaders = append(uploaders, newAPIUploader())
+	}
+	if args.WebhookURL != "" {
+		webhook, err := newWebhookUploader(
+			args.WebhookURL,
+			args.WebhookToken,
+			args.WebhookHeaders,
+			args.WebhookCAFile,
+			args.WebhookLocal)
+		if err != nil {
+			return nil, err
+		}
+		uploaders = append(uploaders, webhook)
+	}
+	if args.MQTTBroker != "" {
+		// The device name is needed for the topic. A device that hasn't
+		// been registered yet still reports events to the other uploaders.
+		if device, err := getDeviceName(args.ConfigDir); err != nil {
+			log.Errorf("MQTT uploader disabled, failed to get device name: %v", err)
+		} else {
+			uploaders = append(uploaders, newMQTTUploader(
+				args.MQTTBroker,
+				args.MQTTTopic,
+				args.MQTTUsername,
+				args.MQTTPassword,
+				device,
+				args.MQTTLocal))
+		}
+	}
+	if len(uploaders) == 0 {
+		return nil, errors.New("no uploaders configured")
+	}
+	return uploaders, nil
+}
+
+// knownUploaders are the names of all the uploaders. Ones that aren't
+// configured are unregistered as destinations so events aren't kept for them.
+var knownUploaders = []string{"api", "webhook", "mqtt"}
+
+func registerUploaders(store *eventstore.EventStore, uploaders []Uploader) error {
+	configured := map[string]bool{}
+	for _, uploader := range uploaders {
+		configured[uploader.Name()] = true
+		if err := store.RegisterDestination(uploader.Name()); err != nil {
+			return err
+		}
+	}
+	for _, name := range knownUploaders {
+		if !configured[name] {
+			if err := store.UnregisterDestination(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pendingCount returns how many events still need to be sent by at least
+// one of the uploaders.
+func pendingCount(store *eventstore.EventStore, uploaders []Uploader) (int, error) {
+	pending := map[uint64]struct{}{}
+	for _, uploader := range uploaders {
+		keys, err := store.PendingFor(uploader.Name())
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			pending[key] = struct{}{}
 		}
 	}
+	return len(pending), nil
 }
 
 func emptyChannel(ch chan time.Time) {
@@ -201,46 +353,108 @@ func emptyChannel(ch chan time.Time) {
 	}
 }
 
-func sendEvents(
-	store *eventstore.EventStore,
-	eventKeys []uint64,
-	cr *connrequester.ConnectionRequester,
-) {
-	cr.Start()
-	defer cr.Stop()
-	if err := cr.WaitUntilUpLoop(connTimeout, connRetryInterval, connMaxRetries); err != nil {
-		log.Println("unable to get an internet connection. Not reporting events")
-		return
-	}
+// uploadResult is how many events were sent to and failed to be sent to
+// the uploaders. An event sent to two uploaders is counted twice.
+type uploadResult struct {
+	sent         int
+	failed       int
+	permanentErr error // The last error that retrying won't fix.
+}
 
-	apiClient, err := api.New()
+// failure returns the error of an upload attempt, the transient error
+// returned by sendEvents, or failing that the last permanent error.
+func (r uploadResult) failure(err error) error {
 	if err != nil {
-		log.Warnf("API connection failed: %v", err)
-		return
+		return err
 	}
+	return r.permanentErr
+}
 
-	groupedEvents, err := getGroupEvents(store, eventKeys)
-	if err != nil {
-		log.Errorf("error grouping events: %v", err)
+func sendEvents(
+	store *eventstore.EventStore,
+	cr connectionRequester,
+	uploaders []Uploader,
+	quarantineAfter int,
+) (uploadResult, error) {
+	var result uploadResult
+	if needsConnection(uploaders) {
+		cr.Start()
+		defer cr.Stop()
+		if err := cr.WaitUntilUpLoop(connTimeout, connRetryInterval, connMaxRetries); err != nil {
+			log.Println("unable to get an internet connection. Not reporting events")
+			return result, fmt.Errorf("no internet connection: %w", err)
+		}
 	}
-	log.Printf("%d event%s to send in %d group%s",
-		len(eventKeys), plural(len(eventKeys)),
-		len(groupedEvents), plural(len(groupedEvents)))
 
+	// Only errors that might go away on retrying count as a failed upload.
 	var errs []error
-	successEvents := 0
-	successGroup := 0
-	for _, groupedEvent := range groupedEvents {
-		if err := apiClient.ReportEvent([]byte(groupedEvent.description), groupedEvent.times); err != nil {
-			errs = append(errs, err)
-		} else {
-			if err := store.DeleteKeys(groupedEvent.keys); err != nil {
-				log.Errorf("failed to delete recordings from store: %v", err)
-				return
+	var transientErr error
+	for _, uploader := range uploaders {
+		eventKeys, err := store.PendingFor(uploader.Name())
+		if err != nil {
+			return result, err
+		}
+		if len(eventKeys) == 0 {
+			continue
+		}
+		if closer, ok := uploader.(closingUploader); ok {
+			defer closer.Close()
+		}
+		groupedEvents, err := getGroupEvents(store, eventKeys)
+		if err != nil {
+			log.Errorf("error grouping events: %v", err)
+		}
+		log.Printf("%d event%s to send to %s in %d group%s",
+			len(eventKeys), plural(len(eventKeys)), uploader.Name(),
+			len(groupedEvents), plural(len(groupedEvents)))
+
+		successEvents := 0
+		successGroup := 0
+		for _, groupedEvent := range groupedEvents {
+			if err := uploader.Upload([]byte(groupedEvent.description), groupedEvent.times); err != nil {
+				err = fmt.Errorf("%s: %w", uploader.Name(), err)
+				errs = append(errs, err)
+				permanent := IsPermanentError(err)
+				if permanent {
+					result.permanentErr = err
+				} else {
+					transientErr = err
+				}
+				failedKeys := groupedEvent.keys
+				if sent := sentEvents(err); sent != nil {
+					var sentKeys []uint64
+					failedKeys = nil
+					for i, key := range groupedEvent.keys {
+						if i < len(sent) && sent[i] {
+							sentKeys = append(sentKeys, key)
+						} else {
+							failedKeys = append(failedKeys, key)
+						}
+					}
+					if err := store.MarkDelivered(uploader.Name(), sentKeys); err != nil {
+						log.Errorf("failed to mark events as delivered: %v", err)
+						return result, err
+					}
+					successEvents += len(sentKeys)
+				}
+				recordFailure(store, uploader.Name(), failedKeys, err, permanent, quarantineAfter)
+				result.failed += len(failedKeys)
+			} else {
+				// Events are deleted once every destination has them.
+				if err := store.MarkDelivered(uploader.Name(), groupedEvent.keys); err != nil {
+					log.Errorf("failed to mark events as delivered: %v", err)
+					return result, err
+				}
+				successEvents += len(groupedEvent.keys)
+				successGroup++
 			}
-			successEvents += len(groupedEvent.keys)
-			successGroup++
 		}
+		if successEvents > 0 {
+			log.Printf("%d event%s sent to %s in %d group%s",
+				successEvents, plural(successEvents), uploader.Name(),
+				successGroup, plural(successGroup))
+		}
+		result.sent += successEvents
 	}
 
 	if len(errs) > 0 {
@@ -249,10 +463,31 @@ func sendEvents(
 			log.Errorf("%v", err)
 		}
 	}
-	if successEvents > 0 {
-		log.Printf("%d event%s sent in %d group%s",
-			successEvents, plural(successEvents),
-			successGroup, plural(successGroup))
+	return result, transientErr
+}
+
+// recordFailure records the failed upload of the events to the destination
+// and quarantines them for it once they have failed permanently too many
+// times, so a malformed event isn't resent forever.
+func recordFailure(store *eventstore.EventStore, destination string, keys []uint64, uploadErr error, permanent bool, quarantineAfter int) {
+	attempts, err := store.RecordFailure(destination, keys, uploadErr, permanent)
+	if err != nil {
+		log.Errorf("failed to record upload failure: %v", err)
+		return
+	}
+	var quarantine []uint64
+	for key, a := range attempts {
+		if a.PermanentFailures >= quarantineAfter {
+			quarantine = append(quarantine, key)
+		}
+	}
+	if len(quarantine) == 0 {
+		return
+	}
+	log.Warnf("quarantining %d event%s for %s that failed %d times: %v",
+		len(quarantine), plural(len(quarantine)), destination, quarantineAfter, uploadErr)
+	if err := store.Quarantine(destination, quarantine); err != nil {
+		log.Errorf("failed to quarantine events: %v", err)
 	}
 }
 
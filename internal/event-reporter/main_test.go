@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package eventreporter
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"sort"
@@ -108,3 +110,218 @@ func (s *Suite) TestGroupingEvents() {
 		s.Equal(expectedGroupLens[i], groupEventsLengths[i], "error with number of events in group")
 	}
 }
+
+func (s *Suite) TestUploadSchedulerBackoff() {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newScheduler := func() *uploadScheduler {
+		scheduler := newUploadScheduler(s.store, 30*time.Minute, 4*time.Hour)
+		scheduler.now = func() time.Time { return now }
+		scheduler.randFloat = func() float64 { return 0 }
+		return scheduler
+	}
+	scheduler := newScheduler()
+	s.True(scheduler.due(), "should upload straight away with no saved state")
+
+	// Backoff starts at the interval and doubles with each failure up to
+	// the maximum.
+	failErr := errors.New("no connection")
+	for _, expected := range []time.Duration{
+		30 * time.Minute,
+		time.Hour,
+		2 * time.Hour,
+		4 * time.Hour,
+		4 * time.Hour,
+	} {
+		scheduler.done(failErr)
+		s.Equal(expected, scheduler.untilNext())
+		s.False(scheduler.due())
+	}
+
+	// Jitter takes up to half of the backoff off.
+	scheduler.randFloat = func() float64 { return 0.5 }
+	scheduler.done(failErr)
+	s.Equal(3*time.Hour, scheduler.untilNext())
+
+	// State is kept over a restart.
+	scheduler = newScheduler()
+	s.Equal(6, scheduler.state.Failures)
+	s.Equal(3*time.Hour, scheduler.untilNext())
+
+	// Success resets back to the normal interval.
+	scheduler.done(nil)
+	s.Equal(0, scheduler.state.Failures)
+	s.Equal(30*time.Minute, scheduler.untilNext())
+	now = now.Add(30 * time.Minute)
+	s.True(scheduler.due())
+}
+
+func (s *Suite) TestUploadSchedulerRetriesNoSoonerThanInterval() {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, maxBackoff := range []time.Duration{10 * time.Minute, time.Hour, 12 * time.Hour} {
+		for _, jitter := range []float64{0, 0.5, 0.999} {
+			scheduler := newUploadScheduler(s.store, 30*time.Minute, maxBackoff)
+			scheduler.now = func() time.Time { return now }
+			scheduler.randFloat = func() float64 { return jitter }
+			scheduler.done(nil)
+			for range 5 {
+				scheduler.done(errors.New("no connection"))
+				s.GreaterOrEqual(scheduler.untilNext(), 30*time.Minute,
+					"max backoff %s, jitter %v", maxBackoff, jitter)
+			}
+		}
+	}
+}
+
+type fakeConnection struct {
+	err error
+}
+
+func (c *fakeConnection) Start() {}
+func (c *fakeConnection) Stop()  {}
+func (c *fakeConnection) WaitUntilUpLoop(timeout, retryAfter time.Duration, maxRetries int) error {
+	return c.err
+}
+
+type fakeUploader struct {
+	uploads map[string]int
+	err     func(description string) error
+}
+
+func newFakeUploader() *fakeUploader {
+	return &fakeUploader{
+		uploads: map[string]int{},
+		err:     func(string) error { return nil },
+	}
+}
+
+func (u *fakeUploader) Name() string {
+	return "fake"
+}
+
+func (u *fakeUploader) Upload(description []byte, times []time.Time) error {
+	event := &eventstore.Event{}
+	if err := json.Unmarshal(description, event); err != nil {
+		return PermanentError(err)
+	}
+	if err := u.err(event.Description.Type); err != nil {
+		return err
+	}
+	u.uploads[event.Description.Type] += len(times)
+	return nil
+}
+
+func (s *Suite) addEvents(eventType string, count int) {
+	for i := range count {
+		s.NoError(s.store.Add(&eventstore.Event{
+			Timestamp:   time.Now().Add(time.Hour * time.Duration(i)),
+			Description: eventstore.EventDescription{Details: map[string]any{"foo": "abc"}, Type: eventType},
+		}))
+	}
+}
+
+func (s *Suite) sendEvents(cr connectionRequester, uploaders ...Uploader) error {
+	_, err := s.sendEventsResult(cr, uploaders...)
+	return err
+}
+
+func (s *Suite) sendEventsResult(cr connectionRequester, uploaders ...Uploader) (uploadResult, error) {
+	s.Require().NoError(registerUploaders(s.store, uploaders))
+	return sendEvents(s.store, cr, uploaders, 2)
+}
+
+func (s *Suite) TestSendEvents() {
+	s.addEvents("type1", 150)
+	s.addEvents("type2", 3)
+	uploader := newFakeUploader()
+
+	s.NoError(s.sendEvents(&fakeConnection{}, uploader))
+	s.Equal(map[string]int{"type1": 150, "type2": 3}, uploader.uploads)
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys, "uploaded events should be deleted")
+}
+
+func (s *Suite) TestSendEventsNoConnection() {
+	s.addEvents("type1", 3)
+	uploader := newFakeUploader()
+
+	s.Error(s.sendEvents(&fakeConnection{err: errors.New("no connection made")}, uploader))
+	s.Empty(uploader.uploads)
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(3, len(keys))
+}
+
+func (s *Suite) TestSendEventsFailures() {
+	s.addEvents("good", 2)
+	s.addEvents("transient", 2)
+	s.addEvents("bad", 2)
+	uploader := newFakeUploader()
+	uploader.err = func(eventType string) error {
+		switch eventType {
+		case "transient":
+			return errors.New("server unavailable")
+		case "bad":
+			return PermanentError(errors.New("invalid event"))
+		}
+		return nil
+	}
+
+	// Transient errors are returned so the upload is retried.
+	result, err := s.sendEventsResult(&fakeConnection{}, uploader)
+	s.Error(err)
+	s.Equal(2, result.sent)
+	s.Equal(4, result.failed)
+	s.EqualError(result.permanentErr, "fake: invalid event")
+	s.Equal(map[string]int{"good": 2}, uploader.uploads)
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(4, len(keys))
+
+	// Events that fail permanently are quarantined after 2 attempts.
+	uploader.err = func(eventType string) error {
+		if eventType == "bad" {
+			return PermanentError(errors.New("invalid event"))
+		}
+		return nil
+	}
+	s.NoError(s.sendEvents(&fakeConnection{}, uploader))
+	s.Equal(map[string]int{"good": 2, "transient": 2}, uploader.uploads)
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+	quarantined, err := s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Equal(2, len(quarantined))
+	q, err := s.store.GetQuarantined(quarantined[0])
+	s.NoError(err)
+	s.Equal("bad", q.Event.Description.Type)
+	s.Equal(2, q.Attempts["fake"].PermanentFailures)
+	s.Equal("fake: invalid event", q.Attempts["fake"].LastError)
+}
+
+func (s *Suite) TestUploadStatus() {
+	s.addEvents("type1", 2)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := newUploadStatus(s.store)
+	status.started(start)
+	status.completed(start.Add(time.Minute), uploadResult{sent: 2}, nil)
+	status.started(start.Add(time.Hour))
+	status.completed(start.Add(time.Hour+time.Minute), uploadResult{}, errors.New("no connection"))
+
+	// Events that fail permanently are a failure too.
+	status.started(start.Add(2 * time.Hour))
+	status.completed(start.Add(2*time.Hour+time.Minute),
+		uploadResult{failed: 2, permanentErr: PermanentError(errors.New("invalid event"))}, nil)
+
+	// The status is loaded again after a restart.
+	got, err := newUploadStatus(s.store).get()
+	s.Require().NoError(err)
+	s.True(got.LastAttempt.Equal(start.Add(2*time.Hour)), got.LastAttempt)
+	s.True(got.LastSuccess.Equal(start.Add(time.Minute)), got.LastSuccess)
+	s.Equal("invalid event", got.LastError)
+	s.Equal(2, got.ConsecutiveFailures)
+	s.Equal(map[string]int{"type1": 2}, got.Pending)
+	s.False(got.OldestPending.IsZero())
+	s.Positive(got.DBSize)
+}
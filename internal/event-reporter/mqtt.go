@@ -0,0 +1,163 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+	config "github.com/TheCacophonyProject/go-config"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttTimeout = 30 * time.Second
+	mqttQoS     = 1   // At least once, so events are only deleted after a PUBACK.
+	mqttQuiesce = 250 // Milliseconds to let outstanding work finish when disconnecting.
+)
+
+// mqttUploader publishes each event to an MQTT broker. The topic is made
+// from a template where {device} is replaced with the device name and
+// {type} with the event type.
+type mqttUploader struct {
+	client mqtt.Client
+	topic  string
+	device string
+	local  bool
+}
+
+func newMQTTUploader(broker, topic, username, password, device string, local bool) *mqttUploader {
+	// Connecting is left until there is something to upload, once the
+	// modem has been brought up, rather than reconnecting in the background.
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("event-reporter-" + device).
+		SetUsername(username).
+		SetPassword(password).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectRetry(false).
+		SetConnectTimeout(mqttTimeout).
+		SetWriteTimeout(mqttTimeout)
+	return &mqttUploader{
+		client: mqtt.NewClient(opts),
+		topic:  topic,
+		device: device,
+		local:  local,
+	}
+}
+
+func getDeviceName(configDir string) (string, error) {
+	conf, err := config.New(configDir)
+	if err != nil {
+		return "", err
+	}
+	var device config.Device
+	if err := conf.Unmarshal(config.DeviceKey, &device); err != nil {
+		return "", err
+	}
+	if device.Name == "" {
+		return "", errors.New("device name not set in config")
+	}
+	return device.Name, nil
+}
+
+func (u *mqttUploader) Name() string {
+	return "mqtt"
+}
+
+func (u *mqttUploader) Offline() bool {
+	return u.local
+}
+
+func (u *mqttUploader) Upload(description []byte, times []time.Time) error {
+	event := &eventstore.Event{}
+	if err := json.Unmarshal(description, event); err != nil {
+		return PermanentError(err)
+	}
+	if err := u.connect(); err != nil {
+		return err
+	}
+
+	topic := mqttTopic(u.topic, u.device, event.Description.Type)
+	var tokens []mqtt.Token
+	for _, t := range times {
+		payload, err := json.Marshal(&eventstore.Event{
+			Timestamp:   t,
+			Description: event.Description,
+		})
+		if err != nil {
+			return PermanentError(err)
+		}
+		tokens = append(tokens, u.client.Publish(topic, mqttQoS, false, payload))
+	}
+	// Events that got a PUBACK are reported as sent even if others in the
+	// group failed, so they aren't published again.
+	deadline := time.Now().Add(mqttTimeout)
+	sent := make([]bool, len(tokens))
+	var publishErr error
+	for i, token := range tokens {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			publishErr = errors.New("timed out waiting for PUBACK")
+		} else if err := token.Error(); err != nil {
+			publishErr = err
+		} else {
+			sent[i] = true
+		}
+	}
+	if publishErr != nil && slices.Contains(sent, true) {
+		return PartialError(publishErr, sent)
+	}
+	return publishErr
+}
+
+// Close disconnects from the broker once the events have been uploaded so
+// keepalive pings don't keep the modem in use. Connections to a local
+// broker are kept open.
+func (u *mqttUploader) Close() {
+	if !u.local && u.client.IsConnectionOpen() {
+		u.client.Disconnect(mqttQuiesce)
+	}
+}
+
+func (u *mqttUploader) connect() error {
+	if u.client.IsConnectionOpen() {
+		return nil
+	}
+	token := u.client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out connecting to MQTT broker")
+	}
+	return token.Error()
+}
+
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttTopic fills in the topic template. The values are escaped so they
+// can't add levels or wildcards to the topic.
+func mqttTopic(template, device, eventType string) string {
+	return strings.NewReplacer(
+		"{device}", mqttTopicEscaper.Replace(device),
+		"{type}", mqttTopicEscaper.Replace(eventType),
+	).Replace(template)
+}
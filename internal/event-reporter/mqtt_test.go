@@ -0,0 +1,147 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMQTTTopic(t *testing.T) {
+	template := "cacophony/{device}/events/{type}"
+	assert.Equal(t, "cacophony/dev1/events/systemError", mqttTopic(template, "dev1", "systemError"))
+	assert.Equal(t, "cacophony/a_b/events/____", mqttTopic(template, "a/b", "#+/#"))
+}
+
+func TestMQTTNoBroker(t *testing.T) {
+	u := newMQTTUploader("tcp://127.0.0.1:1", "events/{type}", "", "", "dev1", true)
+	err := u.Upload([]byte(`{"description":{"type":"a"}}`), []time.Time{time.Now()})
+	assert.Error(t, err)
+	assert.False(t, IsPermanentError(err), "broker being unavailable should be retried")
+}
+
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// fakeMQTTClient fails to publish the payloads that fail returns true for.
+type fakeMQTTClient struct {
+	mqtt.Client
+	connected    bool
+	disconnected int
+	published    []string
+	fail         func(payload string) bool
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return c.connected }
+
+func (c *fakeMQTTClient) Connect() mqtt.Token {
+	c.connected = true
+	return &fakeToken{}
+}
+
+func (c *fakeMQTTClient) Disconnect(quiesce uint) {
+	c.connected = false
+	c.disconnected++
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p := string(payload.([]byte))
+	if c.fail != nil && c.fail(p) {
+		return &fakeToken{err: errors.New("publish failed")}
+	}
+	c.published = append(c.published, p)
+	return &fakeToken{}
+}
+
+func newFakeMQTTUploader(local bool) (*mqttUploader, *fakeMQTTClient) {
+	client := &fakeMQTTClient{}
+	u := newMQTTUploader("tcp://127.0.0.1:1", "events/{type}", "", "", "dev1", local)
+	u.client = client
+	return u, client
+}
+
+func (s *Suite) TestMQTTDisconnectsAfterUpload() {
+	s.addEvents("a", 2)
+	u, client := newFakeMQTTUploader(false)
+	s.NoError(s.sendEvents(&fakeConnection{}, u))
+	s.Len(client.published, 2)
+	s.False(client.connected, "should disconnect so keepalives don't use the modem")
+	s.Equal(1, client.disconnected)
+
+	// Connections to a local broker are kept open.
+	s.addEvents("b", 1)
+	u, client = newFakeMQTTUploader(true)
+	s.NoError(s.sendEvents(&fakeConnection{}, u))
+	s.True(client.connected)
+	s.Zero(client.disconnected)
+}
+
+func (s *Suite) TestMQTTPartialFailure() {
+	s.addEvents("a", 3)
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	u, client := newFakeMQTTUploader(false)
+	failed := 0
+	client.fail = func(payload string) bool {
+		// Fail the second event published.
+		failed++
+		return failed == 2
+	}
+	result, err := s.sendEventsResult(&fakeConnection{}, u)
+	s.Error(err)
+	s.Equal(2, result.sent)
+	s.Equal(1, result.failed)
+	pending, err := s.store.PendingFor("mqtt")
+	s.NoError(err)
+	s.Equal([]uint64{keys[1]}, pending, "events that got a PUBACK shouldn't be resent")
+
+	client.published = nil
+	s.NoError(s.sendEvents(&fakeConnection{}, u))
+	s.Len(client.published, 1)
+	pending, err = s.store.PendingFor("mqtt")
+	s.NoError(err)
+	s.Empty(pending)
+}
+
+func (s *Suite) TestMQTTDisabledWithoutDeviceName() {
+	// The device isn't registered so there is no device name for the topic.
+	uploaders, err := makeUploaders(Args{
+		ConfigDir:  s.tempDir,
+		MQTTBroker: "tcp://127.0.0.1:1",
+		MQTTTopic:  "events/{device}/{type}",
+	})
+	s.NoError(err)
+	s.Require().Len(uploaders, 1)
+	s.Equal("api", uploaders[0].Name())
+}
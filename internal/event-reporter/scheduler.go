@@ -0,0 +1,109 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+const schedulerStateName = "upload-scheduler"
+
+// uploadScheduler decides when events should next be uploaded. After a
+// successful upload it waits the normal interval. After a failure it
+// backs off exponentially from the interval, with jitter so devices that failed together
+// (e.g. when the API is down) don't all retry together. The state is
+// saved in the store so a restart carries on with the same backoff.
+type uploadScheduler struct {
+	store      *eventstore.EventStore
+	interval   time.Duration
+	maxBackoff time.Duration
+	state      schedulerState
+
+	// Replaced in tests.
+	now       func() time.Time
+	randFloat func() float64
+}
+
+type schedulerState struct {
+	Failures    int       `json:"failures"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+func newUploadScheduler(store *eventstore.EventStore, interval, maxBackoff time.Duration) *uploadScheduler {
+	s := &uploadScheduler{
+		store:      store,
+		interval:   interval,
+		maxBackoff: maxBackoff,
+		now:        time.Now,
+		randFloat:  rand.Float64,
+	}
+	if _, err := store.LoadState(schedulerStateName, &s.state); err != nil {
+		log.Errorf("failed to load upload scheduler state: %v", err)
+	}
+	if s.state.Failures > 0 {
+		log.Printf("%d consecutive upload failure%s, next attempt at %s",
+			s.state.Failures, plural(s.state.Failures), s.state.NextAttempt.Format(time.DateTime))
+	}
+	return s
+}
+
+// due returns true if it is time to attempt an upload.
+func (s *uploadScheduler) due() bool {
+	return !s.now().Before(s.state.NextAttempt)
+}
+
+// untilNext returns how long until the next upload attempt.
+func (s *uploadScheduler) untilNext() time.Duration {
+	return max(s.state.NextAttempt.Sub(s.now()), 0)
+}
+
+// done records the result of an upload attempt and schedules the next one.
+func (s *uploadScheduler) done(err error) {
+	if err == nil {
+		s.state.Failures = 0
+		s.state.NextAttempt = s.now().Add(s.interval)
+	} else {
+		s.state.Failures++
+		backoff := s.backoff(s.state.Failures)
+		s.state.NextAttempt = s.now().Add(backoff)
+		log.Printf("upload failed %d time%s in a row, retrying in %s",
+			s.state.Failures, plural(s.state.Failures), backoff.Round(time.Second))
+	}
+	if err := s.store.SaveState(schedulerStateName, s.state); err != nil {
+		log.Errorf("failed to save upload scheduler state: %v", err)
+	}
+}
+
+// backoff returns the delay after the given number of consecutive
+// failures. The delay starts at the interval and doubles with each failure
+// up to maxBackoff, then a random jitter of up to half of it is taken off.
+// It is never shorter than the interval so failing devices don't try
+// more often than working ones.
+func (s *uploadScheduler) backoff(failures int) time.Duration {
+	backoff := s.interval
+	for i := 1; i < failures && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, s.maxBackoff)
+	backoff -= time.Duration(s.randFloat() * float64(backoff/2))
+	return max(backoff, s.interval)
+}
@@ -0,0 +1,174 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema modes, set with --schema-mode.
+const (
+	schemaStrict  = "strict"  // Events that don't match their schema are rejected.
+	schemaLenient = "lenient" // The schema errors are added to the event details.
+	schemaOff     = "off"
+)
+
+// schemaErrorsKey is the detail lenient mode adds to invalid events.
+const schemaErrorsKey = "schemaErrors"
+
+// Schemas for event types made by Cacophony software. Files in the schema
+// directory with the same name replace them.
+//
+//go:embed schemas/*.json
+var builtinSchemas embed.FS
+
+// schemaRegistry has a JSON Schema for the details of known event types.
+// Events of other types aren't checked.
+type schemaRegistry struct {
+	mode    string
+	schemas map[string]*jsonschema.Schema
+}
+
+// validationError is returned when event details don't match the schema
+// of the event type in strict mode.
+type validationError struct {
+	eventType string
+	errs      []string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("'%s' event details are invalid: %s", e.eventType, strings.Join(e.errs, "; "))
+}
+
+// newSchemaRegistry loads the built in schemas and then the schemas in
+// dir, named <event type>.json. dir not existing is fine.
+func newSchemaRegistry(dir, mode string) (*schemaRegistry, error) {
+	switch mode {
+	case schemaStrict, schemaLenient, schemaOff:
+	default:
+		return nil, fmt.Errorf("unknown schema mode '%s', should be %s, %s or %s", mode, schemaStrict, schemaLenient, schemaOff)
+	}
+	r := &schemaRegistry{mode: mode, schemas: map[string]*jsonschema.Schema{}}
+	if mode == schemaOff {
+		return r, nil
+	}
+
+	builtin, err := fs.Sub(builtinSchemas, "schemas")
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(builtin); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if _, err := os.Stat(dir); err == nil {
+			if err := r.load(os.DirFS(dir)); err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *schemaRegistry) load(fsys fs.FS) error {
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		compiler := jsonschema.NewCompiler()
+		if err := compiler.AddResource(name, bytes.NewReader(data)); err != nil {
+			log.Errorf("failed to read event schema '%s': %v", name, err)
+			continue
+		}
+		schema, err := compiler.Compile(name)
+		if err != nil {
+			log.Errorf("failed to compile event schema '%s': %v", name, err)
+			continue
+		}
+		r.schemas[strings.TrimSuffix(filepath.Base(name), ".json")] = schema
+	}
+	return nil
+}
+
+// validate checks the event details against the schema for the type and
+// returns what is wrong with them. Types without a schema are valid.
+func (r *schemaRegistry) validate(eventType string, details map[string]interface{}) []string {
+	if r == nil || r.mode == schemaOff {
+		return nil
+	}
+	schema, ok := r.schemas[eventType]
+	if !ok {
+		return nil
+	}
+	err := schema.Validate(details)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []string{err.Error()}
+	}
+	var errs []string
+	for _, unit := range ve.BasicOutput().Errors {
+		if unit.Error == "" || strings.HasPrefix(unit.Error, "doesn't validate with") {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		errs = append(errs, location+": "+unit.Error)
+	}
+	if len(errs) == 0 {
+		errs = []string{ve.Error()}
+	}
+	return errs
+}
+
+// check validates the details of a new event. In strict mode an error is
+// returned if they are invalid, in lenient mode the errors are added to
+// the details.
+func (r *schemaRegistry) check(eventType string, details map[string]interface{}) error {
+	errs := r.validate(eventType, details)
+	if len(errs) == 0 {
+		return nil
+	}
+	if r.mode == schemaStrict {
+		return &validationError{eventType: eventType, errs: errs}
+	}
+	log.Warnf("'%s' event details are invalid: %s", eventType, strings.Join(errs, "; "))
+	details[schemaErrorsKey] = errs
+	return nil
+}
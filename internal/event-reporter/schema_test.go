@@ -0,0 +1,116 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+func (s *Suite) TestBuiltinSchemas() {
+	r, err := newSchemaRegistry("", schemaStrict)
+	s.Require().NoError(err)
+
+	s.Empty(r.validate("systemError", map[string]interface{}{
+		"version":     "1.2.3",
+		"unitName":    "thermal-recorder.service",
+		"logs":        []interface{}{"line 1", "line 2"},
+		"activeState": "failed",
+		"severity":    "error",
+	}))
+	s.NotEmpty(r.validate("systemError", map[string]interface{}{
+		"unitname":    "thermal-recorder.service",
+		"activeState": "failed",
+	}))
+	s.NotEmpty(r.validate("systemError", map[string]interface{}{
+		"unitName":    "thermal-recorder.service",
+		"activeState": "failed",
+		"logs":        "not a list",
+	}))
+	s.Empty(r.validate("versionData", map[string]interface{}{"event-reporter": "3.0.0"}))
+	s.NotEmpty(r.validate("versionData", map[string]interface{}{"event-reporter": 3}))
+	s.Empty(r.validate("rateLimit", map[string]interface{}{"rate_limited_event": "a", "severity": "error"}))
+	s.NotEmpty(r.validate("rateLimit", map[string]interface{}{}))
+	s.Empty(r.validate("rpiPoweredOff", map[string]interface{}{}))
+	s.Empty(r.validate("unknownType", map[string]interface{}{"anything": 1}))
+
+	_, err = newSchemaRegistry("", "sometimes")
+	s.Error(err)
+}
+
+func (s *Suite) TestSchemaDir() {
+	dir := filepath.Join(s.tempDir, "schemas")
+	s.Require().NoError(os.Mkdir(dir, 0755))
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "rpiBattery.json"), []byte(`{
+		"type": "object",
+		"required": ["voltage"],
+		"properties": {"voltage": {"type": "number"}}
+	}`), 0644))
+	// Replaces the built in schema.
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "rpiPoweredOff.json"), []byte(`{
+		"type": "object",
+		"required": ["reason"]
+	}`), 0644))
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{`), 0644))
+
+	r, err := newSchemaRegistry(dir, schemaStrict)
+	s.Require().NoError(err)
+	s.Empty(r.validate("rpiBattery", map[string]interface{}{"voltage": 3.7}))
+	s.NotEmpty(r.validate("rpiBattery", map[string]interface{}{"voltage": "3.7"}))
+	s.NotEmpty(r.validate("rpiPoweredOff", map[string]interface{}{}))
+	s.NotEmpty(r.validate("systemError", map[string]interface{}{}), "other built in schemas are still used")
+
+	// No schemas are used when off.
+	r, err = newSchemaRegistry(dir, schemaOff)
+	s.Require().NoError(err)
+	s.Empty(r.validate("rpiBattery", map[string]interface{}{}))
+}
+
+func (s *Suite) TestAddValidatesSchema() {
+	invalid := `{"unitname": "thermal-recorder.service", "activeState": "failed"}`
+	now := time.Now().UnixNano()
+
+	strict, err := newSchemaRegistry("", schemaStrict)
+	s.Require().NoError(err)
+	svc := &service{store: s.store, schemas: strict}
+	derr := svc.Add(invalid, "systemError", now)
+	s.Require().NotNil(derr)
+	s.Equal("org.cacophony.Events.Errors.ValidationFailed", derr.Name)
+	s.Nil(svc.Add(`{"unitName": "a.service", "activeState": "failed"}`, "systemError", now))
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(1, len(keys))
+
+	lenient, err := newSchemaRegistry("", schemaLenient)
+	s.Require().NoError(err)
+	svc.schemas = lenient
+	s.Nil(svc.Add(invalid, "systemError", now))
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(2, len(keys))
+	eventBytes, err := s.store.Get(keys[1])
+	s.NoError(err)
+	event := &eventstore.Event{}
+	s.NoError(json.Unmarshal(eventBytes, event))
+	s.NotEmpty(event.Description.Details[schemaErrorsKey])
+}
@@ -37,26 +37,37 @@ const dbusPath = "/org/cacophony/Events"
 // StartService exposes an instance of `service` (see below) on the
 // system DBUS. This allows other processes to queue events for
 // sending.
-func StartService(store *eventstore.EventStore, uploadEventsChan chan bool) error {
+func StartService(
+	store *eventstore.EventStore,
+	uploadEventsChan chan bool,
+	exp *expediter,
+	schemas *schemaRegistry,
+	status *uploadStatus,
+) (*service, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if reply != dbus.RequestNameReplyPrimaryOwner {
-		return errors.New("name already taken")
+		return nil, errors.New("name already taken")
 	}
 
 	svc := &service{
+		conn:             conn,
 		store:            store,
 		uploadEventsChan: uploadEventsChan,
+		expediter:        exp,
+		schemas:          schemas,
+		status:           status,
 	}
 	conn.Export(svc, dbusPath, dbusName)
 	conn.Export(genIntrospectable(svc), dbusPath, "org.freedesktop.DBus.Introspectable")
-	return nil
+	store.SetNotifier(svc)
+	return svc, nil
 }
 
 func genIntrospectable(v interface{}) introspect.Introspectable {
@@ -64,14 +75,91 @@ func genIntrospectable(v interface{}) introspect.Introspectable {
 		Interfaces: []introspect.Interface{{
 			Name:    dbusName,
 			Methods: introspect.Methods(v),
+			Signals: signals,
 		}},
 	}
 	return introspect.NewIntrospectable(node)
 }
 
+// signals are emitted by the service when events are added, dropped and
+// uploaded.
+var signals = []introspect.Signal{
+	{
+		Name: "EventAdded",
+		Args: []introspect.Arg{
+			{Name: "id", Type: "t"},
+			{Name: "type", Type: "s"},
+			{Name: "severity", Type: "s"},
+		},
+	},
+	{Name: "UploadStarted"},
+	{
+		Name: "UploadCompleted",
+		Args: []introspect.Arg{
+			{Name: "sent", Type: "u"},
+			{Name: "failed", Type: "u"},
+			{Name: "error", Type: "s"},
+		},
+	},
+	{
+		Name: "EventsDropped",
+		Args: []introspect.Arg{
+			{Name: "reason", Type: "s"},
+			{Name: "count", Type: "u"},
+		},
+	},
+}
+
 type service struct {
+	conn             *dbus.Conn
 	store            *eventstore.EventStore
 	uploadEventsChan chan bool
+	expediter        *expediter
+	schemas          *schemaRegistry
+	status           *uploadStatus
+}
+
+// emit sends a signal from the service. Nothing is sent if the service
+// isn't exported, as in tests.
+func (svc *service) emit(name string, values ...interface{}) {
+	if svc == nil || svc.conn == nil {
+		return
+	}
+	if err := svc.conn.Emit(dbusPath, dbusName+"."+name, values...); err != nil {
+		log.Errorf("failed to emit %s signal: %v", name, err)
+	}
+}
+
+// EventAdded emits the EventAdded signal and expedites an upload if the
+// event is an error. It is called by the event store once the event has
+// been stored, so rate limited and repeated events aren't included. The
+// rateLimit event made when they are dropped doesn't expedite either.
+func (svc *service) EventAdded(key uint64, event *eventstore.Event) {
+	severity, _ := event.Description.Details[eventclient.SeverityKey].(string)
+	if severity == "" {
+		severity = eventclient.SeverityInfo
+	}
+	svc.emit("EventAdded", key, event.Description.Type, severity)
+	if severity == eventclient.SeverityError && event.Description.Type != eventstore.RateLimitType {
+		svc.expediter.errorEvent(event.Description.Type)
+	}
+}
+
+// EventsDropped emits the EventsDropped signal. It is called by the event store.
+func (svc *service) EventsDropped(reason string, count int) {
+	svc.emit("EventsDropped", reason, uint32(count))
+}
+
+func (svc *service) uploadStarted() {
+	svc.emit("UploadStarted")
+}
+
+func (svc *service) uploadCompleted(result uploadResult, err error) {
+	errString := ""
+	if err := result.failure(err); err != nil {
+		errString = err.Error()
+	}
+	svc.emit("UploadCompleted", uint32(result.sent), uint32(result.failed), errString)
 }
 
 // UploadEvents requests for events to be uploaded now.
@@ -92,7 +180,7 @@ func (svc *service) UploadEvents() *dbus.Error {
 // The event details must be supplied as JSON encoded bytes and the
 // timestamp as the number of nanoseconds since 1970-01-01 UTC.
 func (svc *service) Queue(details []byte, nanos int64) *dbus.Error {
-	err := svc.store.Queue(details, time.Unix(0, nanos))
+	err := svc.store.AddLegacy(details, time.Unix(0, nanos))
 	if err != nil {
 		return &dbus.Error{
 			Name: dbusName + ".Errors.QueueFailed",
@@ -104,13 +192,86 @@ func (svc *service) Queue(details []byte, nanos int64) *dbus.Error {
 
 func (svc *service) Add(detailsRaw string, eventType string, unixNsec int64) *dbus.Error {
 	log.Debugf("Adding event: %s, type: %s, unixNsec: %d", detailsRaw, eventType, unixNsec)
+	event, derr := svc.newEvent(detailsRaw, eventType, unixNsec)
+	if derr != nil {
+		return derr
+	}
+	if err := svc.store.Add(event); err != nil {
+		return dbusErr(".Errors.AddFailed", err)
+	}
+	return nil
+}
+
+// AddWithID adds an event like Add and returns the key it was given, or 0
+// if it was rate limited.
+func (svc *service) AddWithID(detailsRaw string, eventType string, unixNsec int64) (uint64, *dbus.Error) {
+	log.Debugf("Adding event: %s, type: %s, unixNsec: %d", detailsRaw, eventType, unixNsec)
+	event, derr := svc.newEvent(detailsRaw, eventType, unixNsec)
+	if derr != nil {
+		return 0, derr
+	}
+	id, err := svc.store.AddWithID(event)
+	if err != nil {
+		return 0, dbusErr(".Errors.AddFailed", err)
+	}
+	return id, nil
+}
+
+// AddIdempotent adds an event like Add, unless an event with the same
+// idempotency key was added in the last day. The key of the event is
+// returned, or of the original event if it's a repeat. The key is 0 if
+// the event was rate limited.
+func (svc *service) AddIdempotent(detailsRaw string, eventType string, unixNsec int64, idempotencyKey string) (uint64, *dbus.Error) {
+	log.Debugf("Adding event: %s, type: %s, unixNsec: %d, idempotencyKey: %s", detailsRaw, eventType, unixNsec, idempotencyKey)
+	event, derr := svc.newEvent(detailsRaw, eventType, unixNsec)
+	if derr != nil {
+		return 0, derr
+	}
+	id, err := svc.store.AddIdempotent(event, idempotencyKey)
+	if err != nil {
+		return 0, dbusErr(".Errors.AddFailed", err)
+	}
+	return id, nil
+}
+
+// batchEvent is an event as given to AddBatch, the same as the arguments
+// to Add.
+type batchEvent struct {
+	Details  string
+	Type     string
+	UnixNsec int64
+}
+
+// AddBatch adds several events in one call and one database transaction.
+func (svc *service) AddBatch(batch []batchEvent) *dbus.Error {
+	log.Debugf("Adding batch of %d events", len(batch))
+	events := make([]eventstore.Event, 0, len(batch))
+	for _, b := range batch {
+		event, derr := svc.newEvent(b.Details, b.Type, b.UnixNsec)
+		if derr != nil {
+			return derr
+		}
+		events = append(events, *event)
+	}
+	if err := svc.store.AddMany(events); err != nil {
+		return dbusErr(".Errors.AddFailed", err)
+	}
+	return nil
+}
+
+// newEvent makes an event from the arguments given to the Add methods,
+// checking the details against the schema for the event type.
+func (svc *service) newEvent(detailsRaw string, eventType string, unixNsec int64) (*eventstore.Event, *dbus.Error) {
 	details := map[string]interface{}{}
 	if detailsRaw != "" && detailsRaw != "null" {
 		if err := json.Unmarshal([]byte(detailsRaw), &details); err != nil {
-			return dbusErr("", err)
+			return nil, dbusErr("", err)
 		}
 	}
 	log.Debug("Details: ", details)
+	if err := svc.schemas.check(eventType, details); err != nil {
+		return nil, dbusErr(".Errors.ValidationFailed", err)
+	}
 	environment, err := saltutil.GetNodegroupFromFile()
 	if err != nil {
 		log.Errorf("failed to read nodegroup file: %v", err)
@@ -133,11 +294,7 @@ func (svc *service) Add(detailsRaw string, eventType string, unixNsec int64) *db
 			setSeverityErrorTime(time.Now())
 		}
 	}
-
-	if err := svc.store.Add(event); err != nil {
-		return dbusErr(".Errors.AddFailed", err)
-	}
-	return nil
+	return event, nil
 }
 
 func (svc *service) Get(key uint64) (string, *dbus.Error) {
@@ -160,6 +317,133 @@ func (svc *service) Delete(key uint64) *dbus.Error {
 	return dbusErr(".Errors.DeleteFailed", svc.store.Delete(key))
 }
 
+// GetQuarantinedKeys returns the keys of events that were quarantined
+// after repeatedly failing to upload.
+func (svc *service) GetQuarantinedKeys() ([]uint64, *dbus.Error) {
+	keys, err := svc.store.GetQuarantinedKeys()
+	if err != nil {
+		return nil, dbusErr(".Errors.GetQuarantinedKeysFailed", err)
+	}
+	return keys, nil
+}
+
+// GetQuarantined returns a quarantined event and its failed upload
+// attempts as JSON.
+func (svc *service) GetQuarantined(key uint64) (string, *dbus.Error) {
+	q, err := svc.store.GetQuarantined(key)
+	if err != nil {
+		return "", dbusErr(".Errors.GetQuarantinedFailed", err)
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return "", dbusErr(".Errors.GetQuarantinedFailed", err)
+	}
+	return string(data), nil
+}
+
+// ReplayQuarantined moves a quarantined event back to be uploaded. The
+// event is given a new key, which is returned.
+func (svc *service) ReplayQuarantined(key uint64) (uint64, *dbus.Error) {
+	newKey, err := svc.store.Replay(key)
+	if err != nil {
+		return 0, dbusErr(".Errors.ReplayQuarantinedFailed", err)
+	}
+	return newKey, nil
+}
+
+// DeleteQuarantined permanently deletes a quarantined event.
+func (svc *service) DeleteQuarantined(key uint64) *dbus.Error {
+	return dbusErr(".Errors.DeleteQuarantinedFailed", svc.store.DeleteQuarantined(key))
+}
+
+// RegisterDestination adds a destination, such as sidekick, that events
+// must be delivered to before they are deleted.
+func (svc *service) RegisterDestination(name string) *dbus.Error {
+	return dbusErr(".Errors.RegisterDestinationFailed", svc.store.RegisterDestination(name))
+}
+
+// UnregisterDestination removes a destination added with RegisterDestination.
+func (svc *service) UnregisterDestination(name string) *dbus.Error {
+	return dbusErr(".Errors.UnregisterDestinationFailed", svc.store.UnregisterDestination(name))
+}
+
+// PendingFor returns the keys of events not yet delivered to the destination.
+func (svc *service) PendingFor(name string) ([]uint64, *dbus.Error) {
+	keys, err := svc.store.PendingFor(name)
+	if err != nil {
+		return nil, dbusErr(".Errors.PendingForFailed", err)
+	}
+	return keys, nil
+}
+
+// MarkDelivered records that the events were delivered to the destination.
+func (svc *service) MarkDelivered(name string, keys []uint64) *dbus.Error {
+	return dbusErr(".Errors.MarkDeliveredFailed", svc.store.MarkDelivered(name, keys))
+}
+
+// GetSince returns up to limit events with a key after cursor as JSON,
+// along with the cursor for getting the next page. A limit of 0 returns
+// all events after the cursor.
+func (svc *service) GetSince(cursor uint64, limit uint32) (string, uint64, *dbus.Error) {
+	events, next, err := svc.store.GetSince(cursor, int(limit))
+	if err != nil {
+		return "", cursor, dbusErr(".Errors.GetSinceFailed", err)
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return "", cursor, dbusErr(".Errors.GetSinceFailed", err)
+	}
+	return string(data), next, nil
+}
+
+// Query returns the events matching the filter as JSON. The filter is a
+// JSON encoded eventstore.Filter.
+func (svc *service) Query(filterRaw string) (string, *dbus.Error) {
+	filter := eventstore.Filter{}
+	if err := json.Unmarshal([]byte(filterRaw), &filter); err != nil {
+		return "", dbusErr(".Errors.QueryFailed", err)
+	}
+	events, err := svc.store.Query(filter)
+	if err != nil {
+		return "", dbusErr(".Errors.QueryFailed", err)
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return "", dbusErr(".Errors.QueryFailed", err)
+	}
+	return string(data), nil
+}
+
+// Ack saves the cursor the collector has got events up to. If the
+// collector is a registered destination the events are marked as
+// delivered to it.
+func (svc *service) Ack(collector string, cursor uint64) *dbus.Error {
+	return dbusErr(".Errors.AckFailed", svc.store.Ack(collector, cursor))
+}
+
+// GetCursor returns the last cursor acknowledged by the collector.
+func (svc *service) GetCursor(collector string) (uint64, *dbus.Error) {
+	cursor, err := svc.store.GetCursor(collector)
+	if err != nil {
+		return 0, dbusErr(".Errors.GetCursorFailed", err)
+	}
+	return cursor, nil
+}
+
+// Status returns the upload status and statistics of the event store as
+// JSON, to help find out why a device hasn't reported.
+func (svc *service) Status() (string, *dbus.Error) {
+	status, err := svc.status.get()
+	if err != nil {
+		return "", dbusErr(".Errors.StatusFailed", err)
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return "", dbusErr(".Errors.StatusFailed", err)
+	}
+	return string(data), nil
+}
+
 func dbusErr(name string, err error) *dbus.Error {
 	if err == nil {
 		return nil
@@ -0,0 +1,143 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+const (
+	spoolIngestInterval = time.Minute
+	ingestingSuffix     = ".ingesting"
+	maxSpoolLineSize    = 1024 * 1024
+)
+
+// watchSpool adds the events spooled by eventclient while event-reporter
+// wasn't running, now and then periodically as clients may have spooled
+// events while it was restarting.
+func (svc *service) watchSpool(dir string) {
+	svc.ingestSpool(dir)
+	go func() {
+		for range time.Tick(spoolIngestInterval) {
+			svc.ingestSpool(dir)
+		}
+	}()
+}
+
+// ingestSpool adds the events in the spool files then deletes them. Each
+// file is renamed first so clients start a new one, see
+// eventclient.SpoolFileSuffix. Files already renamed were being ingested
+// when event-reporter stopped.
+func (svc *service) ingestSpool(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read spool directory: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case strings.HasSuffix(name, ingestingSuffix):
+		case strings.HasSuffix(name, eventclient.SpoolFileSuffix):
+			if err := os.Rename(path, path+ingestingSuffix); err != nil {
+				log.Errorf("failed to take spool file: %v", err)
+				continue
+			}
+			path += ingestingSuffix
+		default:
+			continue
+		}
+		if err := svc.ingestSpoolFile(path); err != nil {
+			log.Errorf("failed to add events from spool file %s: %v", path, err)
+		}
+	}
+}
+
+// ingestSpoolFile adds the events in a spool file then deletes it. Invalid
+// events are dropped. If adding fails the file is kept to try again. The
+// events without idempotency keys are added in one transaction so they
+// can't be added twice; repeats of the others are ignored.
+func (svc *service) ingestSpoolFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Wait for any client that opened the file before it was renamed.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	var events []eventstore.Event
+	var idempotent []eventstore.Event
+	var idempotencyKeys []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxSpoolLineSize)
+	for scanner.Scan() {
+		var spooled eventclient.Event
+		if err := json.Unmarshal(scanner.Bytes(), &spooled); err != nil {
+			log.Errorf("failed to read spooled event: %v", err)
+			continue
+		}
+		details, err := json.Marshal(spooled.Details)
+		if err != nil {
+			log.Errorf("failed to read spooled event: %v", err)
+			continue
+		}
+		event, derr := svc.newEvent(string(details), spooled.Type, spooled.Timestamp.UnixNano())
+		if derr != nil {
+			log.Errorf("dropping spooled '%s' event: %v", spooled.Type, derr)
+			continue
+		}
+		if spooled.IdempotencyKey != "" {
+			idempotent = append(idempotent, *event)
+			idempotencyKeys = append(idempotencyKeys, spooled.IdempotencyKey)
+		} else {
+			events = append(events, *event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i := range idempotent {
+		if _, err := svc.store.AddIdempotent(&idempotent[i], idempotencyKeys[i]); err != nil {
+			return err
+		}
+	}
+	if len(events) > 0 {
+		if err := svc.store.AddMany(events); err != nil {
+			return err
+		}
+	}
+	log.Printf("added %d spooled event%s", len(events)+len(idempotent), plural(len(events)+len(idempotent)))
+	return os.Remove(path)
+}
@@ -0,0 +1,92 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+func (s *Suite) writeSpoolFile(path string, lines ...interface{}) {
+	var data []byte
+	for _, line := range lines {
+		if str, ok := line.(string); ok {
+			data = append(data, str...)
+		} else {
+			b, err := json.Marshal(line)
+			s.Require().NoError(err)
+			data = append(data, b...)
+		}
+		data = append(data, '\n')
+	}
+	s.Require().NoError(os.WriteFile(path, data, 0644))
+}
+
+func (s *Suite) TestIngestSpool() {
+	dir := filepath.Join(s.tempDir, "spool")
+	s.Require().NoError(os.Mkdir(dir, 0755))
+	now := time.Now()
+	versionData := eventclient.Event{
+		Timestamp:      now,
+		Type:           "versionData",
+		Details:        map[string]interface{}{"thermal-recorder": "1.2.3"},
+		IdempotencyKey: "versionData-1",
+	}
+	s.writeSpoolFile(filepath.Join(dir, "100"+eventclient.SpoolFileSuffix),
+		eventclient.Event{Timestamp: now, Type: "test", Details: map[string]interface{}{"a": 1}},
+		"not json",
+		// Dropped as it doesn't match the systemError schema.
+		eventclient.Event{Timestamp: now, Type: "systemError", Details: map[string]interface{}{"unitname": "a"}},
+		versionData,
+	)
+	// Left from when event-reporter stopped part way through ingesting it.
+	s.writeSpoolFile(filepath.Join(dir, "200"+eventclient.SpoolFileSuffix+ingestingSuffix),
+		eventclient.Event{Timestamp: now, Type: "test", Details: map[string]interface{}{"a": 2}},
+		versionData,
+	)
+	s.writeSpoolFile(filepath.Join(dir, "other.txt"), "ignored")
+
+	strict, err := newSchemaRegistry("", schemaStrict)
+	s.Require().NoError(err)
+	svc := &service{store: s.store, schemas: strict}
+	svc.ingestSpool(dir)
+
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	types := map[string]int{}
+	for _, key := range keys {
+		event, err := s.store.Get(key)
+		s.NoError(err)
+		var e struct {
+			Description struct{ Type string }
+		}
+		s.NoError(json.Unmarshal(event, &e))
+		types[e.Description.Type]++
+	}
+	s.Equal(map[string]int{"test": 2, "versionData": 1}, types)
+
+	entries, err := os.ReadDir(dir)
+	s.NoError(err)
+	s.Len(entries, 1)
+	s.Equal("other.txt", entries[0].Name())
+}
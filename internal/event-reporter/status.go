@@ -0,0 +1,100 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+const uploadStatusStateName = "upload-status"
+
+// uploadStatus records the upload attempts made by Run for the Status
+// D-Bus method. It is saved in the store so it survives restarts.
+type uploadStatus struct {
+	store *eventstore.EventStore
+	mux   sync.Mutex
+	state uploadState
+}
+
+type uploadState struct {
+	LastAttempt         time.Time `json:"lastAttempt"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastError           string    `json:"lastError"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+}
+
+func newUploadStatus(store *eventstore.EventStore) *uploadStatus {
+	u := &uploadStatus{store: store}
+	if _, err := store.LoadState(uploadStatusStateName, &u.state); err != nil {
+		log.Errorf("failed to load upload status: %v", err)
+	}
+	return u
+}
+
+// started records the start of an upload attempt.
+func (u *uploadStatus) started(now time.Time) {
+	u.update(func(state *uploadState) {
+		state.LastAttempt = now
+	})
+}
+
+// completed records the result of the upload attempt. It failed if any
+// events failed to upload, even if retrying won't help.
+func (u *uploadStatus) completed(now time.Time, result uploadResult, err error) {
+	err = result.failure(err)
+	u.update(func(state *uploadState) {
+		if err == nil {
+			state.LastSuccess = now
+			state.ConsecutiveFailures = 0
+		} else {
+			state.LastError = err.Error()
+			state.ConsecutiveFailures++
+		}
+	})
+}
+
+func (u *uploadStatus) update(f func(*uploadState)) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	f(&u.state)
+	if err := u.store.SaveState(uploadStatusStateName, u.state); err != nil {
+		log.Errorf("failed to save upload status: %v", err)
+	}
+}
+
+// get returns the upload status along with the statistics of the store.
+func (u *uploadStatus) get() (*eventclient.Status, error) {
+	stats, err := u.store.Stats()
+	if err != nil {
+		return nil, err
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return &eventclient.Status{
+		Stats:               stats,
+		LastAttempt:         u.state.LastAttempt,
+		LastSuccess:         u.state.LastSuccess,
+		LastError:           u.state.LastError,
+		ConsecutiveFailures: u.state.ConsecutiveFailures,
+	}, nil
+}
@@ -0,0 +1,209 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/TheCacophonyProject/go-api"
+)
+
+// Uploader sends events somewhere. Events with the same description are
+// grouped together, description is the JSON encoded description and
+// times holds when each of the events happened. An error wrapped with
+// PermanentError should be returned if retrying the upload won't help.
+type Uploader interface {
+	Name() string
+	Upload(description []byte, times []time.Time) error
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// PermanentError marks an upload error as one that retrying won't fix,
+// such as the event being rejected as invalid.
+func PermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanentError returns true if the error was marked with PermanentError.
+func IsPermanentError(err error) bool {
+	var pErr *permanentError
+	return errors.As(err, &pErr)
+}
+
+type partialError struct {
+	err  error
+	sent []bool
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+// PartialError is returned by uploaders that send each event separately
+// when only some of them were sent. sent[i] is true if the event at
+// times[i] was sent, so it isn't sent again.
+func PartialError(err error, sent []bool) error {
+	if err == nil {
+		return nil
+	}
+	return &partialError{err: err, sent: sent}
+}
+
+// sentEvents returns which events were sent if the error was made with
+// PartialError, or nil if none of them were.
+func sentEvents(err error) []bool {
+	var pErr *partialError
+	if errors.As(err, &pErr) {
+		return pErr.sent
+	}
+	return nil
+}
+
+// offlineUploader is implemented by uploaders that might not need an
+// internet connection, such as ones sending to the local network.
+type offlineUploader interface {
+	Offline() bool
+}
+
+// needsConnection returns true if any of the uploaders need the internet.
+func needsConnection(uploaders []Uploader) bool {
+	for _, uploader := range uploaders {
+		if offline, ok := uploader.(offlineUploader); !ok || !offline.Offline() {
+			return true
+		}
+	}
+	return false
+}
+
+// closingUploader is implemented by uploaders that keep a connection open
+// while uploading, which is closed once all their events have been sent.
+type closingUploader interface {
+	Close()
+}
+
+// connectionRequester is what is needed from connrequester to bring the
+// modem up while uploading.
+type connectionRequester interface {
+	Start()
+	Stop()
+	WaitUntilUpLoop(timeout, retryAfter time.Duration, maxRetries int) error
+}
+
+// isPermanentHTTPStatus returns true for the HTTP statuses that mean
+// retrying an upload won't help. Failing to authenticate and being asked
+// to try again later say nothing about the events so are retried, as are
+// errors where no response was received (code 0).
+func isPermanentHTTPStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code >= 400 && code < 500
+}
+
+// apiStatusPattern matches the errors go-api returns for failed requests,
+// which only have the HTTP status in their message.
+var apiStatusPattern = regexp.MustCompile(`^HTTP request failed \((\d{3})\)`)
+
+// apiErrorStatus returns the HTTP status of a failed API request, or 0 if
+// no response was received.
+func apiErrorStatus(err error) int {
+	match := apiStatusPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(match[1])
+	return code
+}
+
+// eventReporter is what apiUploader needs from the API client.
+type eventReporter interface {
+	ReportEvent(jsonDetails []byte, times []time.Time) error
+}
+
+// apiUploader uploads events to the Cacophony Project API.
+type apiUploader struct {
+	newClient func() (eventReporter, error)
+	client    eventReporter
+}
+
+func newAPIUploader() *apiUploader {
+	return &apiUploader{
+		newClient: func() (eventReporter, error) { return api.New() },
+	}
+}
+
+func (u *apiUploader) Name() string {
+	return "api"
+}
+
+func (u *apiUploader) Upload(description []byte, times []time.Time) error {
+	// The API client returns a bad description as a plain error, which
+	// would otherwise be retried like a network error.
+	var details map[string]interface{}
+	if err := json.Unmarshal(description, &details); err != nil {
+		return PermanentError(err)
+	}
+	// The API client can only be made once there is a connection.
+	if u.client == nil {
+		client, err := u.newClient()
+		if err != nil {
+			log.Warnf("API connection failed: %v", err)
+			return err
+		}
+		u.client = client
+	}
+	err := u.client.ReportEvent(description, times)
+	if err == nil {
+		return nil
+	}
+	status := apiErrorStatus(err)
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		// Log in again next time in case the token has expired.
+		u.client = nil
+	}
+	if isPermanentHTTPStatus(status) {
+		return PermanentError(err)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"errors"
+	"time"
+)
+
+type fakeAPIClient struct {
+	err error
+}
+
+func (c *fakeAPIClient) ReportEvent(jsonDetails []byte, times []time.Time) error {
+	return c.err
+}
+
+func (s *Suite) TestAPIUploaderErrors() {
+	logins := 0
+	client := &fakeAPIClient{}
+	uploader := newAPIUploader()
+	uploader.newClient = func() (eventReporter, error) {
+		logins++
+		return client, nil
+	}
+	description := []byte(`{"description":{"type":"test"}}`)
+
+	s.NoError(uploader.Upload(description, []time.Time{time.Now()}))
+	s.True(IsPermanentError(uploader.Upload([]byte("not json"), nil)))
+
+	client.err = errors.New("HTTP request failed (400): invalid event")
+	s.True(IsPermanentError(uploader.Upload(description, nil)))
+	for _, msg := range []string{
+		"HTTP request failed (408): timeout",
+		"HTTP request failed (429): slow down",
+		"HTTP request failed (500): server error",
+		"dial tcp: connection refused",
+	} {
+		client.err = errors.New(msg)
+		err := uploader.Upload(description, nil)
+		s.Error(err, msg)
+		s.False(IsPermanentError(err), msg)
+	}
+	s.Equal(1, logins)
+
+	// Authentication failures are retried with a new login.
+	for _, msg := range []string{
+		"HTTP request failed (401): unauthorized",
+		"HTTP request failed (403): forbidden",
+	} {
+		client.err = errors.New(msg)
+		err := uploader.Upload(description, nil)
+		s.Error(err, msg)
+		s.False(IsPermanentError(err), msg)
+	}
+	client.err = nil
+	s.NoError(uploader.Upload(description, nil))
+	s.Equal(3, logins)
+}
+
+func (s *Suite) TestThrottledUploadsNotQuarantined() {
+	s.addEvents("test", 2)
+	client := &fakeAPIClient{}
+	uploader := newAPIUploader()
+	uploader.newClient = func() (eventReporter, error) { return client, nil }
+
+	for _, msg := range []string{
+		"HTTP request failed (429): slow down",
+		"HTTP request failed (401): unauthorized",
+	} {
+		client.err = errors.New(msg)
+		for range 3 {
+			s.Error(s.sendEvents(&fakeConnection{}, uploader))
+		}
+	}
+	quarantined, err := s.store.GetQuarantinedKeys()
+	s.NoError(err)
+	s.Empty(quarantined)
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Len(keys, 2)
+
+	client.err = nil
+	s.NoError(s.sendEvents(&fakeConnection{}, uploader))
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+}
@@ -0,0 +1,139 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventstore"
+)
+
+const webhookTimeout = 30 * time.Second
+
+// webhookUploader POSTs events as JSON to an HTTP endpoint. The body is
+// in the same format as sent to the Cacophony API:
+//
+//	{"description": {"type": "...", "details": {...}}, "dateTimes": [...]}
+type webhookUploader struct {
+	url     string
+	token   string
+	headers map[string]string
+	local   bool
+	client  *http.Client
+}
+
+type webhookPayload struct {
+	Description eventstore.EventDescription `json:"description"`
+	DateTimes   []time.Time                 `json:"dateTimes"`
+}
+
+// newWebhookUploader makes an uploader for the given URL. If token is set
+// it is sent as a bearer token. headers are given as "Name: value". If
+// caFile is set the certificates in it are trusted as well as the system
+// ones. local should be true if the endpoint is reachable without an
+// internet connection.
+func newWebhookUploader(url, token string, headers []string, caFile string, local bool) (*webhookUploader, error) {
+	u := &webhookUploader{
+		url:     url,
+		token:   token,
+		headers: map[string]string{},
+		local:   local,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid webhook header '%s', should be 'Name: value'", header)
+		}
+		u.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+		}
+		u.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return u, nil
+}
+
+func (u *webhookUploader) Name() string {
+	return "webhook"
+}
+
+func (u *webhookUploader) Offline() bool {
+	return u.local
+}
+
+func (u *webhookUploader) Upload(description []byte, times []time.Time) error {
+	event := &eventstore.Event{}
+	if err := json.Unmarshal(description, event); err != nil {
+		return PermanentError(err)
+	}
+	body, err := json.Marshal(webhookPayload{
+		Description: event.Description,
+		DateTimes:   times,
+	})
+	if err != nil {
+		return PermanentError(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	for name, value := range u.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("HTTP request failed (%d): %s", resp.StatusCode, respBody)
+	if isPermanentHTTPStatus(resp.StatusCode) {
+		return PermanentError(err)
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package eventreporter
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	payloads []webhookPayload
+	headers  []http.Header
+}
+
+func newWebhookServer(tls bool) *webhookServer {
+	w := &webhookServer{status: http.StatusOK}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.payloads = append(w.payloads, payload)
+		w.headers = append(w.headers, r.Header)
+		rw.WriteHeader(w.status)
+	})
+	if tls {
+		w.Server = httptest.NewTLSServer(handler)
+	} else {
+		w.Server = httptest.NewServer(handler)
+	}
+	return w
+}
+
+func (s *Suite) TestWebhookUploader() {
+	server := newWebhookServer(false)
+	defer server.Close()
+	webhook, err := newWebhookUploader(server.URL, "secret", []string{"X-Device: 123"}, "", true)
+	s.Require().NoError(err)
+
+	s.addEvents("type1", 3)
+	s.NoError(s.sendEvents(&fakeConnection{}, webhook))
+	s.Require().Equal(1, len(server.payloads))
+	s.Equal("type1", server.payloads[0].Description.Type)
+	s.Equal("abc", server.payloads[0].Description.Details["foo"])
+	s.Equal(3, len(server.payloads[0].DateTimes))
+	s.Equal("Bearer secret", server.headers[0].Get("Authorization"))
+	s.Equal("123", server.headers[0].Get("X-Device"))
+	s.Equal("application/json", server.headers[0].Get("Content-Type"))
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+
+	server.status = http.StatusServiceUnavailable
+	err = webhook.Upload([]byte(`{"description":{"type":"a"}}`), []time.Time{time.Now()})
+	s.Error(err)
+	s.False(IsPermanentError(err))
+	server.status = http.StatusBadRequest
+	err = webhook.Upload([]byte(`{"description":{"type":"a"}}`), []time.Time{time.Now()})
+	s.True(IsPermanentError(err))
+}
+
+func (s *Suite) TestWebhookCAFile() {
+	server := newWebhookServer(true)
+	defer server.Close()
+
+	// Not trusted without the CA file.
+	webhook, err := newWebhookUploader(server.URL, "", nil, "", true)
+	s.Require().NoError(err)
+	s.Error(webhook.Upload([]byte(`{"description":{"type":"a"}}`), []time.Time{time.Now()}))
+
+	caFile := filepath.Join(s.tempDir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	s.Require().NoError(os.WriteFile(caFile, certPEM, 0644))
+	webhook, err = newWebhookUploader(server.URL, "", nil, caFile, true)
+	s.Require().NoError(err)
+	s.NoError(webhook.Upload([]byte(`{"description":{"type":"a"}}`), []time.Time{time.Now()}))
+}
+
+func (s *Suite) TestDeleteOnlyWhenAllUploadersSucceed() {
+	server := newWebhookServer(false)
+	defer server.Close()
+	server.status = http.StatusServiceUnavailable
+	webhook, err := newWebhookUploader(server.URL, "", nil, "", true)
+	s.Require().NoError(err)
+	uploader := newFakeUploader()
+
+	s.addEvents("type1", 3)
+	s.Error(s.sendEvents(&fakeConnection{}, uploader, webhook))
+	keys, err := s.store.GetKeys()
+	s.NoError(err)
+	s.Equal(3, len(keys), "events should be kept until every uploader has them")
+	pending, err := s.store.PendingFor(uploader.Name())
+	s.NoError(err)
+	s.Empty(pending)
+
+	// Only the uploader that failed is sent the events again.
+	server.status = http.StatusOK
+	s.NoError(s.sendEvents(&fakeConnection{}, uploader, webhook))
+	s.Equal(map[string]int{"type1": 3}, uploader.uploads)
+	s.Equal(2, len(server.payloads))
+	keys, err = s.store.GetKeys()
+	s.NoError(err)
+	s.Empty(keys)
+}
@@ -128,6 +128,11 @@ func Run(inputArgs []string, ver string) error {
 		}
 	}
 
+	client, err := eventclient.NewClient()
+	if err != nil {
+		return err
+	}
+
 	conn, err := systemdbus.NewWithContext(context.Background())
 	if err != nil {
 		log.Printf("failed to connect to dbus: %v", err)
@@ -187,27 +192,13 @@ func Run(inputArgs []string, ver string) error {
 			}
 			log.Debug("Version: ", version)
 
-			// If it is a snapshot then we don't need to be making service errors.
-			if strings.Contains(version, "SNAPSHOT") {
-				log.Infof("Skipping making service error for SNAPSHOT. Unit '%s', version '%s'", unitName, version)
-				break
-			}
-
-			event := eventclient.Event{
-				Timestamp: ts,
-				Type:      "systemError",
-				Details: map[string]interface{}{
-					"version":               version,
-					"unitName":              unitName,
-					"logs":                  rawLogs,
-					"activeState":           activeState,
-					eventclient.SeverityKey: eventclient.SeverityError,
-				},
-			}
-			if err := eventclient.AddEvent(event); err != nil {
+			reported, err := reportServiceError(client, ts, unitName, activeState, version, rawLogs)
+			if err != nil {
 				return err
 			}
-			lastUnitReportTimes[unitName] = time.Now()
+			if reported {
+				lastUnitReportTimes[unitName] = time.Now()
+			}
 
 		case err := <-errCh:
 			log.Printf("error reading systemd property change: %v", err)
@@ -216,6 +207,37 @@ func Run(inputArgs []string, ver string) error {
 	}
 }
 
+// reportServiceError adds a systemError event for the failed service. It
+// returns false if the event wasn't made as the service is a snapshot.
+func reportServiceError(
+	sink eventclient.EventSink,
+	ts time.Time,
+	unitName, activeState, version string,
+	logs []string,
+) (bool, error) {
+	// If it is a snapshot then we don't need to be making service errors.
+	if strings.Contains(version, "SNAPSHOT") {
+		log.Infof("Skipping making service error for SNAPSHOT. Unit '%s', version '%s'", unitName, version)
+		return false, nil
+	}
+
+	event := eventclient.Event{
+		Timestamp: ts,
+		Type:      "systemError",
+		Details: map[string]interface{}{
+			"version":               version,
+			"unitName":              unitName,
+			"logs":                  logs,
+			"activeState":           activeState,
+			eventclient.SeverityKey: eventclient.SeverityError,
+		},
+	}
+	if err := sink.AddEvent(context.Background(), event); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func getLogs(unitName string, numLines int) ([]string, bool, error) {
 	failed := false
 	cmd := exec.Command(
@@ -0,0 +1,51 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package servicewatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient/eventclienttest"
+)
+
+func TestReportServiceError(t *testing.T) {
+	r := eventclienttest.NewRecorder()
+	reported, err := reportServiceError(r, time.Now(), "thermal-recorder", "failed", "2.1.0", []string{"line 1", "line 2"})
+	assert.NoError(t, err)
+	assert.True(t, reported)
+	r.AssertCount(t, "systemError", 1)
+	r.AssertDetailsContain(t, "systemError", map[string]interface{}{
+		"unitName":              "thermal-recorder",
+		"activeState":           "failed",
+		"version":               "2.1.0",
+		"logs":                  []string{"line 1", "line 2"},
+		eventclient.SeverityKey: eventclient.SeverityError,
+	})
+
+	// Snapshots don't make service errors.
+	r.Reset()
+	reported, err = reportServiceError(r, time.Now(), "thermal-recorder", "failed", "2.1.0-SNAPSHOT-abc", nil)
+	assert.NoError(t, err)
+	assert.False(t, reported)
+	assert.Empty(t, r.Events())
+}
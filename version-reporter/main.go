@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package versionreporter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -79,17 +80,38 @@ func Run(inputArgs []string, ver string) error {
 		return err
 	}
 
+	client, err := eventclient.NewClient()
+	if err != nil {
+		return err
+	}
+	return reportVersions(client, packageMpedData)
+}
+
+// Time to wait before trying to add the event again. Replaced in tests.
+var retryDelay = 5 * time.Second
+
+// reportVersions adds a versionData event with the package versions and
+// requests for the events to be uploaded. Adding the event is tried 3
+// times before giving up.
+func reportVersions(sink eventclient.EventSink, versions map[string]interface{}) error {
+	ctx := context.Background()
 	event := eventclient.Event{
 		Timestamp: time.Now(),
 		Type:      "versionData",
-		Details:   packageMpedData,
+		Details:   versions,
 	}
+	// So retrying doesn't add a duplicate if the first add worked but the reply was lost.
+	event.IdempotencyKey = fmt.Sprintf("versionData-%d", event.Timestamp.UnixNano())
 
 	for i := 3; i > 0; i-- {
-		err := eventclient.AddEvent(event)
+		err := sink.AddEvent(ctx, event)
 		if err == nil {
 			log.Println("Added versionData event, requesting upload of events.")
-			if err := eventclient.UploadEvents(); err != nil {
+			err := sink.UploadEvents(ctx)
+			if errors.Is(err, eventclient.ErrServiceUnavailable) {
+				// The event was spooled for event-reporter to add when it starts.
+				log.Println("event-reporter isn't running, the versionData event will be uploaded when it starts.")
+			} else if err != nil {
 				return err
 			}
 			break
@@ -98,8 +120,8 @@ func Run(inputArgs []string, ver string) error {
 			log.Println(err)
 			break
 		}
-		log.Println("Failed to log event. Will retry in 5 seconds.")
-		time.Sleep(5 * time.Second)
+		log.Printf("Failed to log event. Will retry in %s.", retryDelay)
+		time.Sleep(retryDelay)
 	}
 
 	return nil
@@ -0,0 +1,67 @@
+/*
+event-reporter - report events to the Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package versionreporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient/eventclienttest"
+)
+
+func TestReportVersions(t *testing.T) {
+	r := eventclienttest.NewRecorder()
+	versions := map[string]interface{}{"event-reporter": "3.1.0", "classifier-pipeline": "1.0"}
+	assert.NoError(t, reportVersions(r, versions))
+	r.AssertCount(t, "versionData", 1)
+	r.AssertDetailsContain(t, "versionData", versions)
+	assert.Equal(t, 1, r.Uploads())
+	assert.NotEmpty(t, r.Events()[0].IdempotencyKey)
+}
+
+func TestReportVersionsFails(t *testing.T) {
+	retryDelay = 0
+	r := eventclienttest.NewRecorder()
+	r.Err = errors.New("event-reporter down")
+	// Failing to add the event is only logged.
+	assert.NoError(t, reportVersions(r, map[string]interface{}{}))
+	assert.Empty(t, r.Events())
+	assert.Zero(t, r.Uploads())
+}
+
+// spooledSink adds events but can't request an upload, like a Client that
+// spooled the events because event-reporter isn't running.
+type spooledSink struct {
+	*eventclienttest.Recorder
+}
+
+func (spooledSink) UploadEvents(ctx context.Context) error {
+	return eventclient.ErrServiceUnavailable
+}
+
+func TestReportVersionsSpooled(t *testing.T) {
+	r := eventclienttest.NewRecorder()
+	assert.NoError(t, reportVersions(spooledSink{r}, map[string]interface{}{"event-reporter": "3.1.0"}))
+	r.AssertCount(t, "versionData", 1)
+	assert.Zero(t, r.Uploads())
+}